@@ -0,0 +1,141 @@
+package cntdb
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+)
+
+var errBadAggregation = errors.New("cntdb: bad aggregation")
+
+// Aggregation determines how the minute values of a bucket are combined.
+// Minute values are the totals of all matching series.
+type Aggregation string
+
+// Supported aggregations. Mean and percentile values are rounded to the
+// nearest integer.
+const (
+	AggSum   Aggregation = "sum"   // total of all values
+	AggCount Aggregation = "count" // number of non-empty minutes
+	AggMin   Aggregation = "min"   // lowest minute value
+	AggMax   Aggregation = "max"   // highest minute value
+	AggMean  Aggregation = "mean"  // average of non-empty minutes
+)
+
+// AggPercentile returns the p-th percentile (0 < p <= 100) of the minute
+// values, using the nearest-rank method.
+func AggPercentile(p float64) Aggregation {
+	return Aggregation("p" + strconv.FormatFloat(p, 'f', -1, 64))
+}
+
+// Valid returns true if the aggregation is supported.
+func (a Aggregation) Valid() bool {
+	switch a {
+	case AggSum, AggCount, AggMin, AggMax, AggMean:
+		return true
+	}
+	_, ok := a.percentile()
+	return ok
+}
+
+func (a Aggregation) percentile() (float64, bool) {
+	if len(a) < 2 || a[0] != 'p' {
+		return 0, false
+	}
+	p, err := strconv.ParseFloat(string(a[1:]), 64)
+	if err != nil || p <= 0 || p > 100 {
+		return 0, false
+	}
+	return p, true
+}
+
+// reduces the values of a bucket, values must not be empty
+func (a Aggregation) reduce(vals []int64) int64 {
+	switch a {
+	case AggCount:
+		return int64(len(vals))
+	case AggMin, AggMax:
+		res := vals[0]
+		for _, v := range vals[1:] {
+			if (a == AggMin && v < res) || (a == AggMax && v > res) {
+				res = v
+			}
+		}
+		return res
+	case AggMean:
+		var sum int64
+		for _, v := range vals {
+			sum += v
+		}
+		return int64(math.Round(float64(sum) / float64(len(vals))))
+	}
+
+	p, _ := a.percentile()
+	sort.Slice(vals, func(i, j int) bool { return vals[i] < vals[j] })
+	rank := int(math.Ceil(p / 100 * float64(len(vals))))
+	if rank < 1 {
+		rank = 1
+	}
+	return vals[rank-1]
+}
+
+// --------------------------------------------------------------------
+
+// bucketer accumulates values into buckets.
+type bucketer struct {
+	bkt      bucketing
+	agg      Aggregation
+	sums     map[time.Time]int64 // bucket totals, for sums
+	minutes  map[time.Time]int64 // minute totals, for other aggregations
+	from, to time.Time           // last used bucket
+}
+
+func newBucketer(bkt bucketing, agg Aggregation) *bucketer {
+	b := &bucketer{bkt: bkt, agg: agg}
+	if agg == AggSum {
+		b.sums = make(map[time.Time]int64, 100)
+	} else {
+		b.minutes = make(map[time.Time]int64, 100)
+	}
+	return b
+}
+
+// Add adds a value.
+func (b *bucketer) Add(ts time.Time, val int64) {
+	if b.sums != nil {
+		b.sums[b.start(ts)] += val
+	} else {
+		b.minutes[ts] += val
+	}
+}
+
+// Results returns the aggregated buckets.
+func (b *bucketer) Results() ResultSet {
+	if b.sums != nil {
+		return newResultSet(b.sums, b.bkt)
+	}
+
+	buckets := make(map[time.Time][]int64)
+	for ts, val := range b.minutes {
+		start := b.start(ts)
+		buckets[start] = append(buckets[start], val)
+	}
+
+	acc := make(map[time.Time]int64, len(buckets))
+	for ts, vals := range buckets {
+		acc[ts] = b.agg.reduce(vals)
+	}
+	return newResultSet(acc, b.bkt)
+}
+
+// returns the bucket start of ts, reuses the last bucket where possible
+func (b *bucketer) start(ts time.Time) time.Time {
+	if !ts.Before(b.from) && ts.Before(b.to) {
+		return b.from
+	}
+	b.from = b.bkt.Start(ts)
+	b.to = b.bkt.Next(b.from)
+	return b.from
+}
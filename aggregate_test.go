@@ -0,0 +1,92 @@
+package cntdb
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-redis/redis"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Aggregation", func() {
+
+	It("should validate", func() {
+		Expect(AggSum.Valid()).To(BeTrue())
+		Expect(AggMean.Valid()).To(BeTrue())
+		Expect(AggPercentile(95).Valid()).To(BeTrue())
+		Expect(AggPercentile(99.9).Valid()).To(BeTrue())
+		Expect(AggPercentile(0).Valid()).To(BeFalse())
+		Expect(AggPercentile(101).Valid()).To(BeFalse())
+		Expect(Aggregation("avg").Valid()).To(BeFalse())
+	})
+
+	It("should reduce", func() {
+		vals := []int64{7, 1, 4, 10, 3}
+		Expect(AggCount.reduce(vals)).To(Equal(int64(5)))
+		Expect(AggMin.reduce(vals)).To(Equal(int64(1)))
+		Expect(AggMax.reduce(vals)).To(Equal(int64(10)))
+		Expect(AggMean.reduce(vals)).To(Equal(int64(5)))
+		Expect(AggPercentile(50).reduce(vals)).To(Equal(int64(4)))
+		Expect(AggPercentile(90).reduce(vals)).To(Equal(int64(10)))
+		Expect(AggPercentile(100).reduce(vals)).To(Equal(int64(10)))
+		Expect(AggPercentile(1).reduce(vals)).To(Equal(int64(1)))
+	})
+
+	Describe("queries", func() {
+		var subject *DB
+		var client *redis.Client
+
+		query := func(agg Aggregation) (ResultSet, error) {
+			return subject.Query(context.Background(), &Criteria{
+				Metric:    "req",
+				From:      xmltime("2014-10-24T09:00:00Z"),
+				Until:     xmltime("2014-10-24T10:59:00Z"),
+				Interval:  time.Hour,
+				Aggregate: agg,
+			})
+		}
+
+		BeforeEach(func() {
+			subject, client = openTestDB("2014-10-25T00:00:00Z")
+
+			Expect(subject.Increment([]Point{
+				point("req,a 1414141200 2"), // 2014-10-24T09:00:00Z
+				point("req,b 1414141200 3"), // 2014-10-24T09:00:00Z
+				point("req,a 1414141260 4"), // 2014-10-24T09:01:00Z
+				point("req,a 1414141800 1"), // 2014-10-24T09:10:00Z
+				point("req,b 1414144800 6"), // 2014-10-24T10:00:00Z
+			})).To(Succeed())
+		})
+
+		AfterEach(func() {
+			closeTestDB(client)
+		})
+
+		It("should aggregate minute totals per bucket", func() {
+			tests := []struct {
+				agg Aggregation
+				res ResultSet
+			}{
+				{"", ResultSet{{xmltime("2014-10-24T09:00:00Z"), 10, xmltime("2014-10-24T10:00:00Z")}, {xmltime("2014-10-24T10:00:00Z"), 6, xmltime("2014-10-24T11:00:00Z")}}},
+				{AggCount, ResultSet{{xmltime("2014-10-24T09:00:00Z"), 3, xmltime("2014-10-24T10:00:00Z")}, {xmltime("2014-10-24T10:00:00Z"), 1, xmltime("2014-10-24T11:00:00Z")}}},
+				{AggMin, ResultSet{{xmltime("2014-10-24T09:00:00Z"), 1, xmltime("2014-10-24T10:00:00Z")}, {xmltime("2014-10-24T10:00:00Z"), 6, xmltime("2014-10-24T11:00:00Z")}}},
+				{AggMax, ResultSet{{xmltime("2014-10-24T09:00:00Z"), 5, xmltime("2014-10-24T10:00:00Z")}, {xmltime("2014-10-24T10:00:00Z"), 6, xmltime("2014-10-24T11:00:00Z")}}},
+				{AggMean, ResultSet{{xmltime("2014-10-24T09:00:00Z"), 3, xmltime("2014-10-24T10:00:00Z")}, {xmltime("2014-10-24T10:00:00Z"), 6, xmltime("2014-10-24T11:00:00Z")}}},
+				{AggPercentile(50), ResultSet{{xmltime("2014-10-24T09:00:00Z"), 4, xmltime("2014-10-24T10:00:00Z")}, {xmltime("2014-10-24T10:00:00Z"), 6, xmltime("2014-10-24T11:00:00Z")}}},
+			}
+
+			for _, test := range tests {
+				res, err := query(test.agg)
+				Expect(err).NotTo(HaveOccurred(), "for %s", test.agg)
+				Expect(res).To(Equal(test.res), "for %s", test.agg)
+			}
+		})
+
+		It("should reject bad aggregations", func() {
+			_, err := query("avg")
+			Expect(err).To(Equal(errBadAggregation))
+		})
+	})
+
+})
@@ -0,0 +1,197 @@
+package cntdb
+
+import "time"
+
+// Calendar is a calendar interval. Calendar buckets start at midnight and
+// may vary in length.
+type Calendar int
+
+const (
+	// CalendarNone uses fixed intervals.
+	CalendarNone Calendar = iota
+	// CalendarDay buckets by day.
+	CalendarDay
+	// CalendarWeek buckets by week, starting on Monday.
+	CalendarWeek
+	// CalendarWeekSunday buckets by week, starting on Sunday.
+	CalendarWeekSunday
+	// CalendarMonth buckets by month.
+	CalendarMonth
+	// CalendarQuarter buckets by quarter.
+	CalendarQuarter
+	// CalendarYear buckets by year.
+	CalendarYear
+)
+
+// bucketing determines the boundaries of query buckets. Unless a location
+// is set, fixed intervals are aligned to UTC and calendar intervals use
+// UTC days. Bucket starts are shifted by offset. Within a location, fixed
+// intervals below a day are aligned to the zone offset, but keep their
+// length across DST changes.
+type bucketing struct {
+	interval time.Duration
+	calendar Calendar
+	loc      *time.Location
+	offset   time.Duration
+}
+
+// Anchored returns a bucketing with an offset, so that a bucket starts at
+// anchor.
+func (b bucketing) Anchored(anchor time.Time) bucketing {
+	b.offset = 0
+	b.offset = b.wall(anchor).Sub(b.wall(b.Start(anchor)))
+	return b
+}
+
+// Start returns the start of the bucket containing t.
+func (b bucketing) Start(t time.Time) time.Time {
+	if b.calendar == CalendarNone && b.loc == nil {
+		return t.Add(-b.offset).Truncate(b.interval).Add(b.offset).Local()
+	} else if b.subDay() {
+		_, zoff := t.In(b.loc).Zone()
+		shift := time.Duration(zoff)*time.Second - b.offset
+		return t.Add(shift).Truncate(b.interval).Add(-shift).In(b.loc)
+	}
+
+	w := b.wall(t).Add(-b.offset)
+	y, m, d := w.Date()
+	switch b.calendar {
+	case CalendarNone:
+		w = w.Truncate(b.interval)
+	case CalendarDay:
+		w = time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+	case CalendarWeek:
+		w = time.Date(y, m, d-(int(w.Weekday())+6)%7, 0, 0, 0, 0, time.UTC)
+	case CalendarWeekSunday:
+		w = time.Date(y, m, d-int(w.Weekday()), 0, 0, 0, 0, time.UTC)
+	case CalendarMonth:
+		w = time.Date(y, m, 1, 0, 0, 0, 0, time.UTC)
+	case CalendarQuarter:
+		w = time.Date(y, (m-1)/3*3+1, 1, 0, 0, 0, 0, time.UTC)
+	case CalendarYear:
+		w = time.Date(y, 1, 1, 0, 0, 0, 0, time.UTC)
+	}
+	return b.unwall(w.Add(b.offset))
+}
+
+// Next returns the start of the bucket following the one starting at
+// start.
+func (b bucketing) Next(start time.Time) time.Time {
+	if b.calendar == CalendarNone && b.loc == nil {
+		return start.Add(b.interval)
+	} else if b.subDay() {
+		return b.Start(start.Add(b.interval))
+	}
+
+	w := b.wall(start).Add(-b.offset)
+	switch b.calendar {
+	case CalendarNone:
+		w = w.Add(b.interval)
+	case CalendarDay:
+		w = w.AddDate(0, 0, 1)
+	case CalendarWeek, CalendarWeekSunday:
+		w = w.AddDate(0, 0, 7)
+	case CalendarMonth:
+		w = w.AddDate(0, 1, 0)
+	case CalendarQuarter:
+		w = w.AddDate(0, 3, 0)
+	case CalendarYear:
+		w = w.AddDate(1, 0, 0)
+	}
+	return b.unwall(w.Add(b.offset))
+}
+
+// Starts returns the start times of all buckets between from and until.
+func (b bucketing) Starts(from, until time.Time) []time.Time {
+	var starts []time.Time
+	for ts := b.Start(from); !ts.After(until); ts = b.Next(ts) {
+		starts = append(starts, ts)
+	}
+	return starts
+}
+
+// Nominal returns the nominal length of a bucket.
+func (b bucketing) Nominal() time.Duration {
+	const day = 24 * time.Hour
+
+	switch b.calendar {
+	case CalendarDay:
+		return day
+	case CalendarWeek, CalendarWeekSunday:
+		return 7 * day
+	case CalendarMonth:
+		return 30 * day
+	case CalendarQuarter:
+		return 91 * day
+	case CalendarYear:
+		return 365 * day
+	}
+	return b.interval
+}
+
+// Aligned returns true if all bucket boundaries between from and until
+// are multiples of d since the epoch.
+func (b bucketing) Aligned(d time.Duration, from, until time.Time) bool {
+	if b.calendar == CalendarNone && (b.interval%d != 0 || b.offset%d != 0) {
+		return false
+	} else if b.calendar == CalendarNone && b.loc == nil {
+		return true
+	}
+
+	step := int64(d / time.Second)
+	for ts := b.Start(from); ; ts = b.Next(ts) {
+		if ts.Unix()%step != 0 {
+			return false
+		} else if ts.After(until) {
+			return true
+		}
+	}
+}
+
+// DayGrid returns the step and phase in minutes of bucket boundaries within
+// the UTC days between from and until. It returns false if boundaries do
+// not follow a fixed grid.
+func (b bucketing) DayGrid(from, until time.Time) (step, phase int, ok bool) {
+	const day = 24 * time.Hour
+
+	if b.calendar == CalendarNone && b.loc == nil && day%b.interval == 0 && b.interval%time.Minute == 0 && b.offset%time.Minute == 0 {
+		off := b.offset % b.interval
+		if off < 0 {
+			off += b.interval
+		}
+		return int(b.interval / time.Minute), int(off / time.Minute), true
+	}
+	if b.Aligned(day, from, until) {
+		return minutesPerDay, 0, true
+	}
+	return 0, 0, false
+}
+
+// returns true for fixed intervals below a day within a location
+func (b bucketing) subDay() bool {
+	return b.calendar == CalendarNone && b.loc != nil && b.interval < 24*time.Hour
+}
+
+// converts t to a UTC time with the wall clock of the bucket location
+func (b bucketing) wall(t time.Time) time.Time {
+	t = t.In(b.location())
+	y, m, d := t.Date()
+	return time.Date(y, m, d, t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+}
+
+// converts a wall clock time back into the bucket location
+func (b bucketing) unwall(w time.Time) time.Time {
+	y, m, d := w.Date()
+	t := time.Date(y, m, d, w.Hour(), w.Minute(), w.Second(), w.Nanosecond(), b.location())
+	if b.loc == nil {
+		return t.Local()
+	}
+	return t
+}
+
+func (b bucketing) location() *time.Location {
+	if b.loc == nil {
+		return time.UTC
+	}
+	return b.loc
+}
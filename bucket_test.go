@@ -0,0 +1,243 @@
+package cntdb
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-redis/redis"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("bucketing", func() {
+	berlin, _ := time.LoadLocation("Europe/Berlin")
+
+	at := func(s string) time.Time {
+		t, _ := time.ParseInLocation("2006-01-02 15:04", s, berlin)
+		return t
+	}
+
+	It("should align fixed intervals to UTC by default", func() {
+		subject := bucketing{interval: 24 * time.Hour}
+		Expect(subject.Start(xmltime("2014-10-24T09:13:00Z"))).To(Equal(xmltime("2014-10-24T00:00:00Z")))
+		Expect(subject.Next(xmltime("2014-10-24T00:00:00Z"))).To(Equal(xmltime("2014-10-25T00:00:00Z")))
+	})
+
+	It("should align fixed intervals to locations", func() {
+		subject := bucketing{interval: 24 * time.Hour, loc: berlin}
+		Expect(subject.Start(at("2014-10-24 01:13"))).To(Equal(at("2014-10-24 00:00")))
+		Expect(subject.Start(xmltime("2014-10-24T23:13:00Z"))).To(Equal(at("2014-10-25 00:00")))
+	})
+
+	It("should bucket hours across DST changes", func() {
+		newYork, _ := time.LoadLocation("America/New_York")
+		subject := bucketing{interval: time.Hour, loc: newYork}
+		hours := func(times ...string) []time.Time {
+			res := make([]time.Time, 0, len(times))
+			for _, s := range times {
+				res = append(res, xmltime(s).In(newYork))
+			}
+			return res
+		}
+
+		// fall back, 01:00 local time occurs twice
+		Expect(subject.Starts(xmltime("2014-11-02T04:30:00Z"), xmltime("2014-11-02T07:30:00Z"))).To(Equal(hours(
+			"2014-11-02T04:00:00Z",
+			"2014-11-02T05:00:00Z",
+			"2014-11-02T06:00:00Z",
+			"2014-11-02T07:00:00Z",
+		)))
+		Expect(subject.Start(xmltime("2014-11-02T05:30:00Z"))).To(Equal(hours("2014-11-02T05:00:00Z")[0]))
+		Expect(subject.Start(xmltime("2014-11-02T06:30:00Z"))).To(Equal(hours("2014-11-02T06:00:00Z")[0]))
+
+		// spring forward, 02:00 local time is skipped
+		Expect(subject.Starts(xmltime("2014-03-09T05:30:00Z"), xmltime("2014-03-09T08:30:00Z"))).To(Equal(hours(
+			"2014-03-09T05:00:00Z",
+			"2014-03-09T06:00:00Z",
+			"2014-03-09T07:00:00Z",
+			"2014-03-09T08:00:00Z",
+		)))
+
+		// half-hour zones
+		kolkata, _ := time.LoadLocation("Asia/Kolkata")
+		Expect(bucketing{interval: time.Hour, loc: kolkata}.Start(xmltime("2014-11-02T04:40:00Z"))).To(Equal(xmltime("2014-11-02T04:30:00Z").In(kolkata)))
+	})
+
+	It("should bucket calendar days across DST changes", func() {
+		subject := bucketing{calendar: CalendarDay, loc: berlin}
+		Expect(subject.Starts(at("2014-10-25 12:00"), at("2014-10-27 12:00"))).To(Equal([]time.Time{
+			at("2014-10-25 00:00"),
+			at("2014-10-26 00:00"),
+			at("2014-10-27 00:00"),
+		}))
+		Expect(subject.Next(at("2014-10-26 00:00")).Sub(at("2014-10-26 00:00"))).To(Equal(25 * time.Hour))
+	})
+
+	It("should bucket calendar intervals", func() {
+		tests := []struct {
+			cal   Calendar
+			start time.Time
+			next  time.Time
+		}{
+			{CalendarWeek, at("2014-10-20 00:00"), at("2014-10-27 00:00")},
+			{CalendarWeekSunday, at("2014-10-19 00:00"), at("2014-10-26 00:00")},
+			{CalendarMonth, at("2014-10-01 00:00"), at("2014-11-01 00:00")},
+			{CalendarQuarter, at("2014-10-01 00:00"), at("2015-01-01 00:00")},
+			{CalendarYear, at("2014-01-01 00:00"), at("2015-01-01 00:00")},
+		}
+
+		for _, test := range tests {
+			subject := bucketing{calendar: test.cal, loc: berlin}
+			start := subject.Start(at("2014-10-24 09:13"))
+			Expect(start).To(Equal(test.start), "for %v", test.cal)
+			Expect(subject.Next(start)).To(Equal(test.next), "for %v", test.cal)
+		}
+	})
+
+	It("should apply offsets", func() {
+		subject := bucketing{interval: time.Hour, offset: 15 * time.Minute}
+		Expect(subject.Start(xmltime("2014-10-24T09:10:00Z"))).To(Equal(xmltime("2014-10-24T08:15:00Z")))
+		Expect(subject.Start(xmltime("2014-10-24T09:20:00Z"))).To(Equal(xmltime("2014-10-24T09:15:00Z")))
+		Expect(subject.Next(xmltime("2014-10-24T09:15:00Z"))).To(Equal(xmltime("2014-10-24T10:15:00Z")))
+
+		subject = bucketing{calendar: CalendarDay, loc: berlin, offset: 6 * time.Hour}
+		Expect(subject.Start(at("2014-10-24 05:00"))).To(Equal(at("2014-10-23 06:00")))
+		Expect(subject.Next(at("2014-10-26 06:00"))).To(Equal(at("2014-10-27 06:00")))
+	})
+
+	It("should anchor", func() {
+		subject := bucketing{interval: 7 * time.Minute}.Anchored(xmltime("2014-10-24T09:00:00Z"))
+		Expect(subject.Starts(xmltime("2014-10-24T09:00:00Z"), xmltime("2014-10-24T09:20:00Z"))).To(Equal([]time.Time{
+			xmltime("2014-10-24T09:00:00Z"),
+			xmltime("2014-10-24T09:07:00Z"),
+			xmltime("2014-10-24T09:14:00Z"),
+		}))
+
+		subject = bucketing{calendar: CalendarMonth, loc: berlin}.Anchored(at("2014-10-03 00:00"))
+		Expect(subject.Start(at("2014-10-24 05:00"))).To(Equal(at("2014-10-03 00:00")))
+		Expect(subject.Next(at("2014-10-03 00:00"))).To(Equal(at("2014-11-03 00:00")))
+	})
+
+	It("should check alignment", func() {
+		from, until := xmltime("2014-10-20T00:00:00Z"), xmltime("2014-11-20T00:00:00Z")
+		Expect(bucketing{interval: 24 * time.Hour}.Aligned(time.Hour, from, until)).To(BeTrue())
+		Expect(bucketing{interval: 90 * time.Minute}.Aligned(time.Hour, from, until)).To(BeFalse())
+		Expect(bucketing{calendar: CalendarMonth}.Aligned(24*time.Hour, from, until)).To(BeTrue())
+		Expect(bucketing{calendar: CalendarDay, loc: berlin}.Aligned(time.Hour, from, until)).To(BeTrue())
+		Expect(bucketing{calendar: CalendarDay, loc: berlin}.Aligned(24*time.Hour, from, until)).To(BeFalse())
+		Expect(bucketing{interval: time.Hour, offset: 15 * time.Minute}.Aligned(time.Hour, from, until)).To(BeFalse())
+	})
+
+	It("should determine day grids", func() {
+		from, until := xmltime("2014-10-20T00:00:00Z"), xmltime("2014-11-20T00:00:00Z")
+		grid := func(b bucketing) []int {
+			step, phase, ok := b.DayGrid(from, until)
+			if !ok {
+				return nil
+			}
+			return []int{step, phase}
+		}
+
+		Expect(grid(bucketing{interval: time.Hour})).To(Equal([]int{60, 0}))
+		Expect(grid(bucketing{interval: time.Hour, offset: 75 * time.Minute})).To(Equal([]int{60, 15}))
+		Expect(grid(bucketing{interval: time.Hour, offset: -15 * time.Minute})).To(Equal([]int{60, 45}))
+		Expect(grid(bucketing{interval: 7 * 24 * time.Hour})).To(Equal([]int{1440, 0}))
+		Expect(grid(bucketing{calendar: CalendarMonth})).To(Equal([]int{1440, 0}))
+		Expect(grid(bucketing{interval: 90 * time.Minute})).To(Equal([]int{90, 0}))
+		Expect(grid(bucketing{interval: 7 * time.Minute})).To(BeNil())
+		Expect(grid(bucketing{interval: time.Hour, loc: berlin})).To(BeNil())
+		Expect(grid(bucketing{calendar: CalendarDay, loc: berlin})).To(BeNil())
+	})
+
+	Describe("queries", func() {
+		var subject *DB
+		var client *redis.Client
+
+		BeforeEach(func() {
+			subject, client = openTestDB("2014-10-28T00:00:00Z")
+
+			Expect(subject.Increment([]Point{
+				point("req,a 1414188000 1"), // 2014-10-25T00:00:00+02:00
+				point("req,a 1414270800 2"), // 2014-10-25T23:00:00+02:00
+				point("req,a 1414278000 4"), // 2014-10-26T01:00:00+02:00
+				point("req,a 1414364340 8"), // 2014-10-26T23:59:00+01:00
+			})).To(Succeed())
+		})
+
+		AfterEach(func() {
+			closeTestDB(client)
+		})
+
+		It("should bucket by local days", func() {
+			res, err := subject.Query(context.Background(), &Criteria{
+				Metric:   "req",
+				From:     at("2014-10-25 00:00"),
+				Until:    at("2014-10-26 23:59"),
+				Calendar: CalendarDay,
+				Location: berlin,
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(res).To(Equal(ResultSet{
+				{at("2014-10-25 00:00"), 3, at("2014-10-26 00:00")},
+				{at("2014-10-26 00:00"), 12, at("2014-10-27 00:00")},
+			}))
+		})
+
+		It("should bucket by local hours across DST changes", func() {
+			Expect(subject.Increment([]Point{
+				point("dst,a 1414283400 1"), // 2014-10-26T02:30:00+02:00
+				point("dst,a 1414287000 2"), // 2014-10-26T02:30:00+01:00
+				point("dst,a 1414290600 4"), // 2014-10-26T03:30:00+01:00
+			})).To(Succeed())
+
+			local := func(s string) time.Time { return xmltime(s).In(berlin) }
+			res, err := subject.Query(context.Background(), &Criteria{
+				Metric:   "dst",
+				From:     local("2014-10-26T00:00:00Z"),
+				Until:    local("2014-10-26T02:59:00Z"),
+				Interval: time.Hour,
+				Location: berlin,
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(res).To(Equal(ResultSet{
+				{local("2014-10-26T00:00:00Z"), 1, local("2014-10-26T01:00:00Z")},
+				{local("2014-10-26T01:00:00Z"), 2, local("2014-10-26T02:00:00Z")},
+				{local("2014-10-26T02:00:00Z"), 4, local("2014-10-26T03:00:00Z")},
+			}))
+		})
+
+		It("should bucket points by local days", func() {
+			crit := &Criteria{
+				Metric:   "req",
+				From:     at("2014-10-25 00:00"),
+				Until:    at("2014-10-26 23:59"),
+				Calendar: CalendarDay,
+				Location: berlin,
+			}
+			Expect(subject.QueryPoints(context.Background(), crit)).To(Equal([]Point{
+				point("req,a 1414188000 3"),  // 2014-10-25T00:00:00+02:00
+				point("req,a 1414274400 12"), // 2014-10-26T00:00:00+02:00
+			}))
+
+			Expect(subject.QueryStore(context.Background(), "req.daily", crit)).To(Succeed())
+			Expect(client.HGetAll("s:req.daily,a:16367").Val()).To(Equal(map[string]string{"1320": "3"}))
+			Expect(client.HGetAll("s:req.daily,a:16368").Val()).To(Equal(map[string]string{"1320": "12"}))
+		})
+
+		It("should bucket relative to an anchor", func() {
+			res, err := subject.Query(context.Background(), &Criteria{
+				Metric:   "req",
+				From:     xmltime("2014-10-24T23:00:00Z"),
+				Until:    xmltime("2014-10-26T22:59:00Z"),
+				Interval: 24 * time.Hour,
+				Anchor:   xmltime("2014-10-24T23:00:00Z"),
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(res).To(Equal(ResultSet{
+				{xmltime("2014-10-24T23:00:00Z"), 2, xmltime("2014-10-25T23:00:00Z")},
+				{xmltime("2014-10-25T23:00:00Z"), 12, xmltime("2014-10-26T23:00:00Z")},
+			}))
+		})
+	})
+
+})
@@ -1,20 +1,63 @@
 package cntdb
 
 import (
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 )
 
+// Now may be used as FromAgo or UntilAgo to refer to the time when the
+// query runs.
+const Now time.Duration = -1
+
 type Criteria struct {
-	From     time.Time
-	Until    time.Time
+	From  time.Time
+	Until time.Time
+	// FromAgo and UntilAgo, if set, override From and Until with times
+	// relative to when the query runs, e.g. 7*24h for a week ago, or Now.
+	FromAgo  time.Duration
+	UntilAgo time.Duration
 	Metric   string
-	Tags     []string
+	// Tags restricts the query to series with any of the tags.
+	Tags []string
+	// Filter restricts the query to series matching a tag expression. It
+	// is combined with Tags, if both are set.
+	Filter   TagFilter
 	Interval time.Duration
+	// Calendar, if set, buckets results by calendar intervals instead of
+	// Interval.
+	Calendar Calendar
+	// Location aligns buckets to the local time of a time zone, results
+	// are returned in this location. By default, buckets are aligned to
+	// UTC.
+	Location *time.Location
+	// Offset shifts the start of buckets, e.g. hourly buckets with an
+	// offset of 15m start at a quarter past each hour.
+	Offset time.Duration
+	// Anchor, if set, aligns buckets so that a bucket starts at the anchor
+	// time, e.g. at From. It overrides Offset.
+	Anchor time.Time
+	// GroupBy groups results by tag prefixes, see QueryGrouped. Entries
+	// are plain string prefixes, so host:a also matches host:ab. End them
+	// with a colon to group by all values of a tag key, e.g. host:.
+	GroupBy []string
+	// Aggregate determines how the minute values of each bucket are
+	// combined, AggSum by default. With the exception of AggSum, values are
+	// read from raw data, not from rollup tiers.
+	Aggregate Aggregation
+	// Fill determines how empty buckets between From and Until are filled,
+	// they are omitted by default.
+	Fill FillMode
+	// Transforms are applied to the results in order, after aggregation
+	// and filling.
+	Transforms []Transform
 }
 
 func (c *Criteria) getFrom() timestamp {
+	if c != nil && (c.FromAgo > 0 || c.FromAgo == Now) {
+		return timestamp{agoTime(c.FromAgo)}
+	}
 	if c == nil || c.From.IsZero() {
 		return timestamp{time.Now().Add(-time.Hour)}
 	}
@@ -22,12 +65,23 @@ func (c *Criteria) getFrom() timestamp {
 }
 
 func (c *Criteria) getUntil() timestamp {
+	if c != nil && (c.UntilAgo > 0 || c.UntilAgo == Now) {
+		return timestamp{agoTime(c.UntilAgo)}
+	}
 	if c == nil || c.Until.IsZero() {
 		return timestamp{time.Now()}
 	}
 	return timestamp{c.Until}
 }
 
+// returns the time ago before now
+func agoTime(ago time.Duration) time.Time {
+	if ago == Now {
+		return time.Now()
+	}
+	return time.Now().Add(-ago)
+}
+
 func (c *Criteria) getInterval() time.Duration {
 	if c == nil || c.Interval < time.Minute {
 		return time.Minute
@@ -35,9 +89,61 @@ func (c *Criteria) getInterval() time.Duration {
 	return c.Interval
 }
 
+func (c *Criteria) getBucketing() bucketing {
+	b := bucketing{interval: c.getInterval()}
+	if c == nil {
+		return b
+	}
+
+	b.calendar = c.Calendar
+	b.loc = c.Location
+	if !c.Anchor.IsZero() {
+		return b.Anchored(c.Anchor)
+	}
+	b.offset = c.Offset
+	return b
+}
+
+func (c *Criteria) getAggregate() (Aggregation, error) {
+	if c == nil || c.Aggregate == "" {
+		return AggSum, nil
+	} else if !c.Aggregate.Valid() {
+		return "", errBadAggregation
+	}
+	return c.Aggregate, nil
+}
+
+// returns the combined tag filter of the criteria, nil if unfiltered
+func (c *Criteria) getFilter() TagFilter {
+	if c == nil {
+		return nil
+	}
+
+	var filters andFilter
+	if len(c.Tags) != 0 {
+		tags := make(orFilter, 0, len(c.Tags))
+		for _, tag := range c.Tags {
+			tags = append(tags, tagFilter(tag))
+		}
+		filters = append(filters, tags)
+	}
+	if c.Filter != nil {
+		filters = append(filters, c.Filter)
+	}
+
+	switch len(filters) {
+	case 0:
+		return nil
+	case 1:
+		return filters[0]
+	}
+	return filters
+}
+
 type Result struct {
-	Timestamp time.Time
+	Timestamp time.Time // bucket start
 	Value     int64
+	End       time.Time // bucket end, exclusive
 }
 
 type ResultSet []Result
@@ -46,6 +152,38 @@ func (p ResultSet) Len() int           { return len(p) }
 func (p ResultSet) Less(i, j int) bool { return p[i].Timestamp.Before(p[j].Timestamp) }
 func (p ResultSet) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
 
+// returns a sorted result set from accumulated bucket values
+func newResultSet(acc map[time.Time]int64, bkt bucketing) ResultSet {
+	res := make(ResultSet, 0, len(acc))
+	for ts, val := range acc {
+		res = append(res, Result{ts, val, bkt.Next(ts)})
+	}
+	sort.Sort(res)
+	return res
+}
+
+// Group is a labelled result set of a grouped query.
+type Group struct {
+	// Tags contains the matching tag of each Criteria.GroupBy prefix, or
+	// an empty string if series of the group have no matching tag.
+	Tags    []string
+	Results ResultSet
+}
+
+// returns the group tags of a series
+func groupTags(tags, prefixes []string) []string {
+	res := make([]string, len(prefixes))
+	for i, prefix := range prefixes {
+		for _, tag := range tags {
+			if strings.HasPrefix(tag, prefix) {
+				res[i] = tag
+				break
+			}
+		}
+	}
+	return res
+}
+
 // --------------------------------------------------------------------
 
 type series struct {
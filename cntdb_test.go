@@ -1,9 +1,12 @@
 package cntdb
 
 import (
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/go-redis/redis"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 )
@@ -61,6 +64,51 @@ func xmltime(s string) time.Time {
 	return t.Local()
 }
 
+func fixedClock(s string) func() time.Time {
+	t := xmltime(s)
+	return func() time.Time { return t }
+}
+
+// connects to the test database and returns a DB with its clock fixed at
+// now, clean up with closeTestDB
+func openTestDB(now string) (*DB, *redis.Client) {
+	client := redis.NewClient(&redis.Options{Addr: "localhost:6379", DB: 9})
+	db := NewDBWithClient(client)
+	db.now = fixedClock(now)
+	return db, client
+}
+
+// flushes the test database and closes the client
+func closeTestDB(client *redis.Client) {
+	client.FlushDb()
+	client.Close()
+}
+
+// returns the common test dataset of cpu points over two days
+func cpuPoints() []Point {
+	return []Point{
+		point("cpu,a,b 1414141200 1"),  // 2014-10-24T09:00:00Z
+		point("cpu,a,c 1414141300 2"),  // 2014-10-24T09:01:40Z
+		point("cpu,a,c 1414142000 4"),  // 2014-10-24T09:13:20Z
+		point("cpu,b,c 1414146000 8"),  // 2014-10-24T10:20:00Z
+		point("cpu,a,b 1414200000 16"), // 2014-10-25T01:20:00Z
+		point("cpu,b,c 1414230000 32"), // 2014-10-25T09:40:00Z
+	}
+}
+
+// returns the members of all day index sets of an index
+func indexMembers(client *redis.Client, index string) []string {
+	prefix := dayIndexPrefix(index)
+
+	var members []string
+	for _, name := range client.Keys(prefix + "*").Val() {
+		if _, err := strconv.ParseInt(strings.TrimPrefix(name, prefix), 10, 64); err == nil {
+			members = append(members, client.SMembers(name).Val()...)
+		}
+	}
+	return members
+}
+
 func TestSuite(t *testing.T) {
 	RegisterFailHandler(Fail)
 	RunSpecs(t, "cntdb")
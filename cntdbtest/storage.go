@@ -0,0 +1,255 @@
+// Package cntdbtest provides an in-memory storage for testing code which
+// depends on cntdb without a running Redis server.
+package cntdbtest
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bsm/cntdb"
+)
+
+// NewDB returns a new DB, backed by an in-memory storage.
+func NewDB() *cntdb.DB {
+	return cntdb.New(NewStorage())
+}
+
+type series struct {
+	values  map[int]int64
+	expires time.Time
+}
+
+// Storage is a fully in-process implementation of cntdb.Storage. It mirrors
+// the semantics of the Redis back-end, including key expiry and
+// compaction of index sets.
+type Storage struct {
+	series map[string]*series
+	index  map[string]map[string]struct{}
+	meta   map[string]map[string]string
+	mu     sync.Mutex
+}
+
+// NewStorage creates a new, empty storage.
+func NewStorage() *Storage {
+	return &Storage{
+		series: make(map[string]*series),
+		index:  make(map[string]map[string]struct{}),
+		meta:   make(map[string]map[string]string),
+	}
+}
+
+// Keys returns all stored series keys and index set names, sorted.
+func (s *Storage) Keys() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	keys := make([]string, 0, len(s.series)+len(s.index))
+	for key, ser := range s.series {
+		if ser.expires.After(now) {
+			keys = append(keys, key)
+		}
+	}
+	for name := range s.index {
+		keys = append(keys, name)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Write implements cntdb.Storage.
+func (s *Storage) Write(batch *cntdb.Batch) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for _, ent := range batch.Entries {
+		ser := s.fetch(ent.Key, now)
+		if ser == nil {
+			ser = &series{values: make(map[int]int64)}
+			s.series[ent.Key] = ser
+		}
+		if batch.Incr {
+			ser.values[ent.Minute] += ent.Value
+		} else {
+			ser.values[ent.Minute] = ent.Value
+		}
+		ser.expires = now.Add(ent.TTL)
+
+		for _, name := range ent.Index {
+			set, ok := s.index[name]
+			if !ok {
+				set = make(map[string]struct{})
+				s.index[name] = set
+			}
+			set[ent.Key] = struct{}{}
+		}
+	}
+	return nil
+}
+
+// ReadMeta implements cntdb.Storage.
+func (s *Storage) ReadMeta(_ context.Context, name string) (map[string]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fields := make(map[string]string, len(s.meta[name]))
+	for field, value := range s.meta[name] {
+		fields[field] = value
+	}
+	return fields, nil
+}
+
+// WriteMeta implements cntdb.Storage.
+func (s *Storage) WriteMeta(name, field, value string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if value == "" {
+		delete(s.meta[name], field)
+		return nil
+	}
+	if _, ok := s.meta[name]; !ok {
+		s.meta[name] = make(map[string]string)
+	}
+	s.meta[name][field] = value
+	return nil
+}
+
+// ScanIndex implements cntdb.Storage.
+func (s *Storage) ScanIndex(ctx context.Context, index string, _, _ int64, fn func(string) error) error {
+	s.mu.Lock()
+	members := make([]string, 0, len(s.index[index]))
+	for member := range s.index[index] {
+		members = append(members, member)
+	}
+	s.mu.Unlock()
+
+	for _, member := range members {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		if err := fn(member); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadSeries implements cntdb.Storage.
+func (s *Storage) ReadSeries(ctx context.Context, ranges []cntdb.SeriesRange, fn func(string, int, int64) error) error {
+	type value struct {
+		key    string
+		minute int
+		value  int64
+	}
+
+	s.mu.Lock()
+	now := time.Now()
+	values := make([]value, 0, len(ranges))
+	for _, r := range ranges {
+		ser := s.fetch(r.Key, now)
+		if ser == nil {
+			continue
+		}
+		for minute, v := range ser.values {
+			if r.Contains(minute) {
+				values = append(values, value{key: r.Key, minute: minute, value: v})
+			}
+		}
+	}
+	s.mu.Unlock()
+
+	for _, v := range values {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		if err := fn(v.key, v.minute, v.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove implements cntdb.Storage.
+func (s *Storage) Remove(_ context.Context, removals []cntdb.Removal) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for _, rem := range removals {
+		if ser := s.fetch(rem.Key, now); ser != nil {
+			for _, minute := range rem.Minutes {
+				delete(ser.values, minute)
+			}
+			if len(rem.Minutes) != 0 && len(ser.values) != 0 {
+				continue
+			}
+			delete(s.series, rem.Key)
+		}
+
+		for _, name := range rem.Index {
+			if set, ok := s.index[name]; ok {
+				delete(set, rem.Key)
+				if len(set) == 0 {
+					delete(s.index, name)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// CompactIndex implements cntdb.Storage. Unlike the Redis back-end, it
+// processes all index sets on every call.
+func (s *Storage) CompactIndex(ctx context.Context, expired func(string) (bool, error), _ bool) (*cntdb.CompactStats, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats := &cntdb.CompactStats{Wrapped: true}
+	for name, set := range s.index {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		default:
+		}
+
+		stats.KeysScanned++
+		for member := range set {
+			if ok, err := expired(member); err != nil {
+				return nil, err
+			} else if ok {
+				delete(set, member)
+				stats.MembersRemoved++
+			}
+		}
+		if len(set) == 0 {
+			delete(s.index, name)
+		}
+	}
+	return stats, nil
+}
+
+// Close implements cntdb.Storage.
+func (s *Storage) Close() error { return nil }
+
+// fetch returns a series, dropping it if expired. Must be called while
+// holding the lock.
+func (s *Storage) fetch(key string, now time.Time) *series {
+	ser, ok := s.series[key]
+	if !ok {
+		return nil
+	} else if !ser.expires.After(now) {
+		delete(s.series, key)
+		return nil
+	}
+	return ser
+}
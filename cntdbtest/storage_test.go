@@ -0,0 +1,98 @@
+package cntdbtest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/bsm/cntdb"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Storage", func() {
+	var store *Storage
+	var subject *cntdb.DB
+
+	BeforeEach(func() {
+		store = NewStorage()
+		subject = cntdb.New(store)
+		Expect(subject.SetRetention("", 100*365*24*time.Hour)).To(Succeed())
+	})
+
+	It("should index keys", func() {
+		Expect(subject.Set([]cntdb.Point{
+			point("cpu,host:a,dc:x 1414141414 2"),
+			point("cpu,host:b,dc:x 1414141414 3"),
+		})).To(Succeed())
+
+		Expect(store.Keys()).To(Equal([]string{
+			"m:cpu",
+			"s:cpu,dc:x,host:a:16367",
+			"s:cpu,dc:x,host:b:16367",
+			"t:dc:x",
+			"t:host:a",
+			"t:host:b",
+		}))
+	})
+
+	It("should compact", func() {
+		Expect(subject.Set([]cntdb.Point{
+			point("cpu,a,b 1414141414 1"),
+			point("cpu,a,c 1818181818 2"),
+			point("cpu,b,c 1414141414 4"),
+			point("cpu,a,c 1818181818 8"),
+			point("mem,a,c 1414141414 16"),
+		})).To(Succeed())
+
+		Expect(subject.SetRetention("", 0)).To(Succeed())
+		Expect(subject.CompactFull(context.Background())).To(Equal(&cntdb.CompactStats{
+			KeysScanned:    5,
+			MembersRemoved: 9,
+			Wrapped:        true,
+		}))
+		Expect(store.Keys()).To(Equal([]string{
+			"m:cpu",
+			"s:cpu,a,b:16367",
+			"s:cpu,a,c:21043",
+			"s:cpu,b,c:16367",
+			"s:mem,a,c:16367",
+			"t:a",
+			"t:c",
+		}))
+	})
+
+	It("should expire series", func() {
+		Expect(subject.Set([]cntdb.Point{point("cpu,a,b 1414141414 1")})).To(Succeed())
+		store.series["s:cpu,a,b:16367"].expires = time.Now().Add(-time.Second)
+		Expect(store.Keys()).To(Equal([]string{"m:cpu", "t:a", "t:b"}))
+
+		res, err := subject.Query(context.Background(), &cntdb.Criteria{
+			Metric: "cpu",
+			From:   xmltime("2014-10-24T09:00:00Z"),
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res).To(BeEmpty())
+	})
+
+})
+
+// --------------------------------------------------------------------
+
+func point(s string) cntdb.Point {
+	pt, err := cntdb.ParsePoint(s)
+	if err != nil {
+		Fail(err.Error())
+	}
+	return pt
+}
+
+func xmltime(s string) time.Time {
+	t, _ := time.Parse(time.RFC3339, s)
+	return t.Local()
+}
+
+func TestSuite(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "cntdb/cntdbtest")
+}
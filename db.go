@@ -3,8 +3,8 @@ package cntdb
 import (
 	"context"
 	"sort"
-	"strconv"
-	"sync/atomic"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/bsm/strset"
@@ -13,60 +13,141 @@ import (
 
 var storageTTL = 35 * 24 * time.Hour
 
+// number of series keys read per round trip
+var scanBatchSize = 500
+
 type DB struct {
-	client *redis.Client
+	store     Storage
+	retention retention
+	rollups   rollups
+	serverSum bool
+	workers   int
 
-	cursor uint64 // compaction cursor
+	now func() time.Time
 }
 
+// NewDB connects to a redis server and returns a new DB.
 func NewDB(addr string, db int) *DB {
-	client := redis.NewClient(&redis.Options{
+	return NewDBWithOptions(&redis.Options{
 		Addr: addr,
 		DB:   db,
 	})
-	return &DB{client: client}
 }
 
-// Compact runs a compaction cycle
-func (b *DB) Compact(ctx context.Context) error {
-	max := timestamp{time.Now().Add(-storageTTL)}.UnixDay()
-	pipe := b.client.Pipeline()
-	defer pipe.Close()
+// NewDBWithOptions connects to a redis server using custom options
+// and returns a new DB.
+func NewDBWithOptions(opt *redis.Options) *DB {
+	store := NewRedisStorage(redis.NewClient(opt))
+	store.owned = true
+	return New(store)
+}
 
-	keys, cursor, err := b.client.Scan(atomic.LoadUint64(&b.cursor), "[mt]:*", 20).Result()
-	if err != nil {
-		return err
+// NewFailoverDB connects to a redis server via Sentinel and returns a new DB.
+func NewFailoverDB(opt *redis.FailoverOptions) *DB {
+	store := NewRedisStorage(redis.NewFailoverClient(opt))
+	store.owned = true
+	return New(store)
+}
+
+// NewDBWithClient returns a new DB using an existing client. The client is
+// not closed when the DB is closed.
+func NewDBWithClient(client *redis.Client) *DB {
+	return New(NewRedisStorage(client))
+}
+
+// NewClusterDB creates a new DB using a client which may be connected to a
+// Redis Cluster. It uses a hash-tagged key layout, which is not compatible with
+// the layout used by NewDB. The client is not closed when the DB is closed.
+func NewClusterDB(client redis.UniversalClient) *DB {
+	return New(NewRedisClusterStorage(client))
+}
+
+// New creates a new DB using a custom storage back-end.
+func New(store Storage) *DB {
+	return &DB{store: store, workers: defaultQueryConcurrency, now: time.Now}
+}
+
+// SetQueryConcurrency sets the maximum number of index sets and batches of
+// series which are read concurrently per query, the default is 4. A failed
+// batch cancels the remaining ones. SetQueryConcurrency must be called
+// before the DB is used.
+func (b *DB) SetQueryConcurrency(workers int) {
+	if workers < 1 {
+		workers = 1
 	}
-	atomic.StoreUint64(&b.cursor, cursor)
+	b.workers = workers
+}
 
-	for _, key := range keys {
+// SetServerAggregation enables summing of values on the server for queries
+// with AggSum, so that only aggregated buckets are transferred. It requires
+// a storage which implements SeriesSummer, buckets which follow a fixed
+// grid within UTC days, and values which can be summed exactly. Queries
+// read raw values otherwise. SetServerAggregation must be called before the
+// DB is used.
+func (b *DB) SetServerAggregation(enabled bool) {
+	b.serverSum = enabled
+}
+
+// Close closes the DB and its storage.
+func (b *DB) Close() error {
+	return b.store.Close()
+}
+
+// Compact runs a compaction cycle. Depending on the storage, only a sample
+// of index sets and members may be inspected.
+func (b *DB) Compact(ctx context.Context) error {
+	_, err := b.compact(ctx, false)
+	return err
+}
+
+// CompactFull runs a compaction cycle which inspects every member of every
+// index set.
+func (b *DB) CompactFull(ctx context.Context) (*CompactStats, error) {
+	return b.compact(ctx, true)
+}
+
+// RunCompactor calls CompactFull in the given interval until the context is
+// cancelled. Errors are passed to onError, which may be nil, and compaction
+// is retried in the next interval.
+func (b *DB) RunCompactor(ctx context.Context, interval time.Duration, onError func(error)) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
-		default:
+		case <-ticker.C:
+			if _, err := b.CompactFull(ctx); err != nil && onError != nil && ctx.Err() == nil {
+				onError(err)
+			}
 		}
+	}
+}
 
-		if err := b.expire(key, pipe, max); err != nil {
-			return err
-		}
+func (b *DB) compact(ctx context.Context, full bool) (*CompactStats, error) {
+	ret, err := b.loadRetention(ctx)
+	if err != nil {
+		return nil, err
 	}
 
-	_, err = pipe.Exec()
-	return err
+	return b.store.CompactIndex(ctx, func(key string) (bool, error) {
+		ser, err := parseSeries(key)
+		if err != nil {
+			return false, err
+		}
+		return b.seriesTTL(ret, ser.metric, ser.unixDay) <= 0, nil
+	}, full)
 }
 
 // Set sets point values
 func (b *DB) Set(points []Point) error {
-	return b.writePoints(points, func(pipe *redis.Pipeline, key, member string, value int64) {
-		pipe.ZAdd(key, redis.Z{Member: member, Score: float64(value)})
-	})
+	return b.writePoints(points, false)
 }
 
 // Increment increments point values to the DB
 func (b *DB) Increment(points []Point) error {
-	return b.writePoints(points, func(pipe *redis.Pipeline, key, member string, value int64) {
-		pipe.ZIncrBy(key, float64(value), member)
-	})
+	return b.writePoints(points, true)
 }
 
 // QueryStore performs a query and writes the results to a different metric
@@ -81,198 +162,336 @@ func (b *DB) QueryStore(ctx context.Context, targetMetric string, c *Criteria) e
 	return b.Set(points)
 }
 
-// QueryPoints performs a query and returns points
+// QueryPoints performs a query and returns points at the start of each
+// bucket, buckets are determined as by Query
 func (b *DB) QueryPoints(ctx context.Context, c *Criteria) ([]Point, error) {
-	from, until := c.getFrom(), c.getUntil()
-	interval := c.getInterval()
-	keys, err := b.scopeKeys(ctx, c.Metric, c.Tags, from, until)
+	return b.queryPoints(ctx, c, true)
+}
+
+func (b *DB) queryPoints(ctx context.Context, c *Criteria, tiers bool) ([]Point, error) {
+	iter := b.scanPoints(ctx, c, tiers)
+
+	var points []Point
+	for iter.Next() {
+		points = append(points, iter.Point())
+	}
+	return points, iter.Err()
+}
+
+func (b *DB) Query(ctx context.Context, c *Criteria) (ResultSet, error) {
+	agg, err := c.getAggregate()
 	if err != nil {
 		return nil, err
 	}
 
-	index := make(map[string]Point, 100)
-	err = b.scanSeries(ctx, keys.Slice(), from, until, func(s series, ts time.Time, val int64) error {
-		point, err := NewPointAt(s.metric, s.tags, ts.Truncate(interval), val)
+	acc := newBucketer(c.getBucketing(), agg)
+	if err := b.scan(ctx, c, agg == AggSum, func(_ series, ts time.Time, val int64) error {
+		acc.Add(ts, val)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return finalize(c, acc.Results()), nil
+}
+
+// QueryGrouped performs a query and returns a result set per group. Series
+// are grouped by their first tag starting with each of the Criteria.GroupBy
+// prefixes, e.g. "host:" groups by host. Prefixes are not tags, "host:a"
+// groups host:a and host:ab separately. Groups are sorted by their tags.
+func (b *DB) QueryGrouped(ctx context.Context, c *Criteria) ([]Group, error) {
+	return b.queryGroups(ctx, c, func(s series) []string {
+		return groupTags(s.tags, c.GroupBy)
+	})
+}
+
+// performs a query, returns a result set per group of series tags
+func (b *DB) queryGroups(ctx context.Context, c *Criteria, groupBy func(series) []string) ([]Group, error) {
+	agg, err := c.getAggregate()
+	if err != nil {
+		return nil, err
+	}
+	bkt := c.getBucketing()
+
+	type group struct {
+		tags []string
+		acc  *bucketer
+	}
+
+	index := make(map[string]*group)
+	if err := b.scan(ctx, c, agg == AggSum, func(s series, ts time.Time, val int64) error {
+		tags := groupBy(s)
+		groupID := strings.Join(tags, ",")
+
+		grp, ok := index[groupID]
+		if !ok {
+			grp = &group{tags: tags, acc: newBucketer(bkt, agg)}
+			index[groupID] = grp
+		}
+		grp.acc.Add(ts, val)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	groupIDs := make([]string, 0, len(index))
+	for groupID := range index {
+		groupIDs = append(groupIDs, groupID)
+	}
+	sort.Strings(groupIDs)
+
+	groups := make([]Group, 0, len(index))
+	for _, groupID := range groupIDs {
+		grp := index[groupID]
+		groups = append(groups, Group{Tags: grp.tags, Results: finalize(c, grp.acc.Results())})
+	}
+	return groups, nil
+}
+
+// fills and transforms aggregated results
+func finalize(c *Criteria, res ResultSet) ResultSet {
+	bkt := c.getBucketing()
+	if c.Fill != FillNone {
+		res = fillBuckets(res, c.Fill, bkt, c.getFrom().Time, c.getUntil().Time)
+	}
+	return applyTransforms(res, bkt.Nominal(), c.Transforms)
+}
+
+// scans all series matching the criteria. If sum is set, the callback only
+// sums values per bucket, so these may be read from rollup tiers or summed
+// on the server.
+func (b *DB) scan(ctx context.Context, c *Criteria, sum bool, callback func(series, time.Time, int64) error) error {
+	segments, err := b.querySegments(ctx, c, sum)
+	if err != nil {
+		return err
+	}
+
+	bkt := c.getBucketing()
+	for _, seg := range segments {
+		keys, err := b.scopeKeys(ctx, seg.metric, c.getFilter(), seg.from, seg.until)
 		if err != nil {
 			return err
 		}
 
-		pointID := point.uID()
-		if ex, ok := index[pointID]; ok {
-			point.count += ex.count
+		// read batches concurrently, serialise callbacks
+		var mu sync.Mutex
+		fn := func(s series, ts time.Time, val int64) error {
+			s.metric = c.Metric
+
+			mu.Lock()
+			defer mu.Unlock()
+			return callback(s, ts, val)
 		}
-		index[pointID] = point
-		return nil
-	})
 
-	points := make([]Point, 0, len(index))
-	for _, point := range index {
-		points = append(points, point)
+		batches := batchKeys(keys.Slice(), scanBatchSize)
+		if err := runChunks(ctx, len(batches), b.workers, func(ctx context.Context, n int) error {
+			if sum {
+				return b.sumSeries(ctx, batches[n], seg.from, seg.until, bkt, fn)
+			}
+			return b.scanSeries(ctx, batches[n], seg.from, seg.until, fn)
+		}); err != nil {
+			return err
+		}
 	}
-	return points, err
+	return nil
 }
 
-func (b *DB) Query(ctx context.Context, c *Criteria) (ResultSet, error) {
+// returns the segments of a query, reads from rollup tiers if allowed
+func (b *DB) querySegments(ctx context.Context, c *Criteria, tiers bool) ([]segment, error) {
 	from, until := c.getFrom(), c.getUntil()
-	interval := c.getInterval()
+	if _, ok := b.rollups.tierOf(c.Metric); !tiers || ok || len(b.rollups.tiers) == 0 {
+		return []segment{{metric: c.Metric, from: from, until: until}}, nil
+	}
 
-	keys, err := b.scopeKeys(ctx, c.Metric, c.Tags, from, until)
+	watermarks, err := b.loadWatermarks(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	acc := make(map[time.Time]int64, 100)
-	if err := b.scanSeries(ctx, keys.Slice(), from, until, func(_ series, ts time.Time, val int64) error {
-		acc[ts.Truncate(interval)] += val
-		return nil
-	}); err != nil {
+	// tier buckets from the earliest dirty bucket onwards are incomplete
+	now := b.now()
+	start, ok, err := b.dirtyFrom(ctx, c.Metric, from.Time, until.Time)
+	if err != nil {
 		return nil, err
+	} else if ok && start.Before(now) {
+		now = start
 	}
-
-	res := make(ResultSet, 0, len(acc))
-	for ts, val := range acc {
-		res = append(res, Result{ts, val})
-	}
-	sort.Sort(res)
-	return res, err
+	return b.rollups.segments(c.Metric, c.getBucketing(), from, until, now, watermarks), nil
 }
 
-// scope all series keys that are relevant for the query
-func (b *DB) scopeKeys(ctx context.Context, metric string, tags []string, from, until timestamp) (*strset.Set, error) {
+// scope all series keys that are relevant for the query, index sets are
+// scanned concurrently
+func (b *DB) scopeKeys(ctx context.Context, metric string, filter TagFilter, from, until timestamp) (*strset.Set, error) {
 	minDay, maxDay := from.UnixDay(), until.UnixDay()
-	scope, err := b.scanIndex(ctx, "m:"+metric, minDay, maxDay)
-	if err != nil {
+
+	indices := []string{"m:" + metric}
+	if filter != nil {
+		seen := make(map[string]bool)
+		for _, tag := range filter.tags() {
+			if !seen[tag] {
+				seen[tag] = true
+				indices = append(indices, "t:"+tag)
+			}
+		}
+	}
+
+	sets := make([]*strset.Set, len(indices))
+	if err := runChunks(ctx, len(indices), b.workers, func(ctx context.Context, n int) error {
+		set, err := b.scanIndex(ctx, indices[n], minDay, maxDay)
+		sets[n] = set
+		return err
+	}); err != nil {
 		return nil, err
 	}
 
-	if len(tags) == 0 {
-		return scope, nil
+	if filter == nil {
+		return sets[0], nil
 	}
 
-	filters := strset.New(10)
-	for _, tag := range tags {
-		sub, err := b.scanIndex(ctx, "t:"+tag, minDay, maxDay)
-		if err != nil {
-			return nil, err
-		}
-		filters = filters.Union(sub)
+	tags := make(map[string]*strset.Set, len(indices)-1)
+	for n, index := range indices[1:] {
+		tags[index[2:]] = sets[n+1]
 	}
-	return scope.Intersect(filters), nil
+	return filter.eval(sets[0], func(tag string) (*strset.Set, error) {
+		return tags[tag], nil
+	})
 }
 
-// scans multiple series and applies callback to each result
+// scans multiple series and applies callback to each result, only reads
+// the minutes within from and until
 func (b *DB) scanSeries(ctx context.Context, keys []string, from, until timestamp, callback func(series, time.Time, int64) error) error {
-	min, max := from.Truncate(time.Minute), until.Truncate(time.Minute)
+	series, ranges, err := seriesRanges(keys, from, until)
+	if err != nil {
+		return err
+	}
 
-	pipe := b.client.Pipeline()
-	defer pipe.Close()
+	// read series, process results
+	return b.store.ReadSeries(ctx, ranges, func(key string, minute int, value int64) error {
+		ser := series[key]
+		return callback(ser, ser.StartTime().Add(time.Duration(minute)*time.Minute), value)
+	})
+}
 
-	// parse/validate keys, build pipeline
-	series := make([]series, len(keys))
-	cmds := make([]*redis.ZSliceCmd, len(keys))
-	for n, key := range keys {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		default:
-		}
+// sums multiple series into buckets on the server and applies callback to
+// each bucket, falls back to scanSeries if server aggregation is disabled
+// or not possible
+func (b *DB) sumSeries(ctx context.Context, keys []string, from, until timestamp, bkt bucketing, callback func(series, time.Time, int64) error) error {
+	summer, ok := b.store.(SeriesSummer)
+	if !b.serverSum || !ok {
+		return b.scanSeries(ctx, keys, from, until, callback)
+	}
 
-		ser, err := parseSeries(key)
-		if err != nil {
-			return err
-		}
-		series[n] = ser
-		cmds[n] = pipe.ZRangeWithScores(key, 0, -1)
+	step, phase, ok := bkt.DayGrid(from.Time, until.Time)
+	if !ok {
+		return b.scanSeries(ctx, keys, from, until, callback)
+	}
+
+	series, ranges, err := seriesRanges(keys, from, until)
+	if err != nil {
+		return err
 	}
-	_, _ = pipe.Exec()
 
-	// iterate over series, process results
-	for n, ser := range series {
-		base := ser.StartTime()
-		pairs, err := cmds[n].Result()
+	err = summer.SumSeries(ctx, ranges, step, phase, func(key string, minute int, sum int64) error {
+		ser := series[key]
+		return callback(ser, ser.StartTime().Add(time.Duration(minute)*time.Minute), sum)
+	})
+	if err == ErrUnsupported {
+		return b.scanSeries(ctx, keys, from, until, callback)
+	}
+	return err
+}
+
+// parses series keys and returns the minute ranges within from and until,
+// skips keys outside of the range
+func seriesRanges(keys []string, from, until timestamp) (map[string]series, []SeriesRange, error) {
+	min, max := timestamp{from.Truncate(time.Minute)}, timestamp{until.Truncate(time.Minute)}
+	minDay, maxDay := min.UnixDay(), max.UnixDay()
+
+	// parse/validate keys, restrict first and last day
+	index := make(map[string]series, len(keys))
+	ranges := make([]SeriesRange, 0, len(keys))
+	for _, key := range keys {
+		ser, err := parseSeries(key)
 		if err != nil {
-			return err
+			return nil, nil, err
 		}
+		if ser.unixDay < minDay || ser.unixDay > maxDay {
+			continue
+		}
+		index[key] = ser
 
-		for _, pair := range pairs {
-			offset, _ := strconv.ParseInt(pair.Member.(string), 10, 64)
-			timestamp := base.Add(time.Duration(offset) * time.Minute)
-			if timestamp.Before(min) || timestamp.After(max) {
-				continue
-			}
-
-			if err := callback(ser, timestamp, int64(pair.Score)); err != nil {
-				return err
-			}
+		r := FullDay(key)
+		if ser.unixDay == minDay {
+			r.Min = int(min.MinuteOfDay())
 		}
+		if ser.unixDay == maxDay {
+			r.Max = int(max.MinuteOfDay())
+		}
+		ranges = append(ranges, r)
 	}
-	return nil
+	return index, ranges, nil
 }
 
-// scans a redis index via SSCAN to retrieve all keys
-func (b *DB) scanIndex(ctx context.Context, key string, minDay, maxDay int64) (*strset.Set, error) {
+// scans an index to retrieve all keys
+func (b *DB) scanIndex(ctx context.Context, index string, minDay, maxDay int64) (*strset.Set, error) {
 	matches := strset.New(10)
-	iter := b.client.SScan(key, 0, "", 1000).Iterator()
-	for iter.Next() {
-		select {
-		case <-ctx.Done():
-			return nil, ctx.Err()
-		default:
-		}
-
-		member := iter.Val()
+	err := b.store.ScanIndex(ctx, index, minDay, maxDay, func(member string) error {
 		series, err := parseSeries(member)
 		if err != nil {
-			return nil, err
+			return err
 		} else if series.unixDay >= minDay && series.unixDay <= maxDay {
 			matches.Add(member)
 		}
-	}
-	if err := iter.Err(); err != nil {
+		return nil
+	})
+	if err != nil {
 		return nil, err
 	}
 	return matches, nil
 }
 
-// writes points
-func (b *DB) writePoints(points []Point, forEach func(*redis.Pipeline, string, string, int64)) error {
-	pipe := b.client.Pipeline()
-	defer pipe.Close()
+// writes points, skips points which are already beyond retention
+func (b *DB) writePoints(points []Point, incr bool) error {
+	ret, err := b.loadRetention(context.Background())
+	if err != nil {
+		return err
+	}
 
-	seen := make(map[string]struct{}, len(points))
-	for _, pt := range points {
-		key := pt.keyName()
-		forEach(pipe, key, pt.memberName(), pt.count)
-		seen[key] = struct{}{}
+	batch := &Batch{
+		Incr:    incr,
+		Entries: make([]Entry, 0, len(points)),
+	}
 
-		pipe.SAdd("m:"+pt.metric, key)
-		for _, tag := range pt.tags {
-			pipe.SAdd("t:"+tag, key)
+	written := make([]Point, 0, len(points))
+	for _, pt := range points {
+		ttl := b.seriesTTL(ret, pt.metric, pt.timestamp.UnixDay())
+		if ttl <= 0 {
+			continue
 		}
+		written = append(written, pt)
+
+		batch.Entries = append(batch.Entries, Entry{
+			Key:    pt.keyName(),
+			Minute: int(pt.timestamp.MinuteOfDay()),
+			Value:  pt.count,
+			Index:  seriesIndex(pt.metric, pt.tags),
+			TTL:    ttl,
+		})
 	}
-
-	for key := range seen {
-		pipe.Expire(key, storageTTL)
+	if len(batch.Entries) == 0 {
+		return nil
 	}
-
-	_, err := pipe.Exec()
-	return err
-}
-
-// expire appends expiration commands to a redis pipeline
-func (b *DB) expire(key string, pipe *redis.Pipeline, max int64) error {
-	members, err := b.client.SRandMemberN(key, 100).Result()
-	if err != nil {
+	if err := b.store.Write(batch); err != nil {
 		return err
 	}
+	return b.markWritten(ret, written)
+}
 
-	for _, member := range members {
-		ser, err := parseSeries(member)
-		if err != nil {
-			return err
-		} else if ser.unixDay < max {
-			pipe.SRem(key, member)
-		}
+// returns the names of the index sets of a series
+func seriesIndex(metric string, tags []string) []string {
+	index := make([]string, 0, len(tags)+1)
+	index = append(index, "m:"+metric)
+	for _, tag := range tags {
+		index = append(index, "t:"+tag)
 	}
-	return nil
+	return index
 }
@@ -7,19 +7,21 @@ import (
 	"testing"
 	"time"
 
+	"github.com/go-redis/redis"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 )
 
 var _ = Describe("DB", func() {
 	var subject *DB
+	var client *redis.Client
 
 	BeforeEach(func() {
-		subject = NewDB("localhost:6379", 9)
+		subject, client = openTestDB("2014-10-25T00:00:00Z")
 	})
 
 	AfterEach(func() {
-		subject.client.FlushDb()
+		closeTestDB(client)
 	})
 
 	It("should set", func() {
@@ -30,30 +32,28 @@ var _ = Describe("DB", func() {
 			point("cpu,host:a,dc:x 1414141414 1"),
 		})
 
-		Expect(subject.client.Keys("*").Val()).To(ConsistOf([]string{
+		Expect(client.Keys("*").Val()).To(ConsistOf([]string{
 			"s:cpu,dc:x,host:b:16367",
 			"s:cpu,dc:x,host:a:16367",
-			"m:cpu",
-			"t:host:b",
-			"t:host:a",
-			"t:dc:x",
+			"md:cpu:16367",
+			"td:host:b:16367",
+			"td:host:a:16367",
+			"td:dc:x:16367",
+			"ml:cpu",
+			"tl:host:a",
+			"tl:host:b",
+			"tl:dc:x",
 		}))
-		Expect(subject.client.TTL("s:cpu,dc:x,host:a:16367").Val()).To(BeNumerically("~", storageTTL, time.Second))
-		Expect(subject.client.TTL("s:cpu,dc:x,host:b:16367").Val()).To(BeNumerically("~", storageTTL, time.Second))
-
-		Expect(subject.client.SMembers("m:cpu").Val()).To(ConsistOf([]string{"s:cpu,dc:x,host:a:16367", "s:cpu,dc:x,host:b:16367"}))
-		Expect(subject.client.SMembers("t:host:a").Val()).To(ConsistOf([]string{"s:cpu,dc:x,host:a:16367"}))
-		Expect(subject.client.SMembers("t:host:b").Val()).To(ConsistOf([]string{"s:cpu,dc:x,host:b:16367"}))
-		Expect(subject.client.SMembers("t:dc:x").Val()).To(ConsistOf([]string{"s:cpu,dc:x,host:a:16367", "s:cpu,dc:x,host:b:16367"}))
-
-		v1 := subject.client.ZRangeWithScores("s:cpu,dc:x,host:a:16367", 0, -1).Val()
-		Expect(v1).To(HaveLen(1))
-		Expect(v1[0].Score).To(Equal(1.0))
-		Expect(v1[0].Member).To(Equal("0543"))
-		v2 := subject.client.ZRangeWithScores("s:cpu,dc:x,host:b:16367", 0, -1).Val()
-		Expect(v2).To(HaveLen(1))
-		Expect(v2[0].Score).To(Equal(3.0))
-		Expect(v2[0].Member).To(Equal("0543"))
+		Expect(client.TTL("s:cpu,dc:x,host:a:16367").Val()).To(BeNumerically("~", storageTTL, time.Second))
+		Expect(client.TTL("s:cpu,dc:x,host:b:16367").Val()).To(BeNumerically("~", storageTTL, time.Second))
+
+		Expect(client.SMembers("md:cpu:16367").Val()).To(ConsistOf([]string{"s:cpu,dc:x,host:a:16367", "s:cpu,dc:x,host:b:16367"}))
+		Expect(client.SMembers("td:host:a:16367").Val()).To(ConsistOf([]string{"s:cpu,dc:x,host:a:16367"}))
+		Expect(client.SMembers("td:host:b:16367").Val()).To(ConsistOf([]string{"s:cpu,dc:x,host:b:16367"}))
+		Expect(client.SMembers("td:dc:x:16367").Val()).To(ConsistOf([]string{"s:cpu,dc:x,host:a:16367", "s:cpu,dc:x,host:b:16367"}))
+
+		Expect(client.HGetAll("s:cpu,dc:x,host:a:16367").Val()).To(Equal(map[string]string{"0543": "1"}))
+		Expect(client.HGetAll("s:cpu,dc:x,host:b:16367").Val()).To(Equal(map[string]string{"0543": "3"}))
 	})
 
 	It("should increment", func() {
@@ -64,30 +64,28 @@ var _ = Describe("DB", func() {
 			point("cpu,host:a,dc:x 1414141414 -1"),
 		})
 
-		Expect(subject.client.Keys("*").Val()).To(ConsistOf([]string{
+		Expect(client.Keys("*").Val()).To(ConsistOf([]string{
 			"s:cpu,dc:x,host:b:16367",
 			"s:cpu,dc:x,host:a:16367",
-			"m:cpu",
-			"t:host:b",
-			"t:host:a",
-			"t:dc:x",
+			"md:cpu:16367",
+			"td:host:b:16367",
+			"td:host:a:16367",
+			"td:dc:x:16367",
+			"ml:cpu",
+			"tl:host:a",
+			"tl:host:b",
+			"tl:dc:x",
 		}))
-		Expect(subject.client.TTL("s:cpu,dc:x,host:a:16367").Val()).To(BeNumerically("~", storageTTL, time.Second))
-		Expect(subject.client.TTL("s:cpu,dc:x,host:b:16367").Val()).To(BeNumerically("~", storageTTL, time.Second))
-
-		Expect(subject.client.SMembers("m:cpu").Val()).To(ConsistOf([]string{"s:cpu,dc:x,host:a:16367", "s:cpu,dc:x,host:b:16367"}))
-		Expect(subject.client.SMembers("t:host:a").Val()).To(ConsistOf([]string{"s:cpu,dc:x,host:a:16367"}))
-		Expect(subject.client.SMembers("t:host:b").Val()).To(ConsistOf([]string{"s:cpu,dc:x,host:b:16367"}))
-		Expect(subject.client.SMembers("t:dc:x").Val()).To(ConsistOf([]string{"s:cpu,dc:x,host:a:16367", "s:cpu,dc:x,host:b:16367"}))
-
-		v1 := subject.client.ZRangeWithScores("s:cpu,dc:x,host:a:16367", 0, -1).Val()
-		Expect(v1).To(HaveLen(1))
-		Expect(v1[0].Score).To(Equal(5.0))
-		Expect(v1[0].Member).To(Equal("0543"))
-		v2 := subject.client.ZRangeWithScores("s:cpu,dc:x,host:b:16367", 0, -1).Val()
-		Expect(v2).To(HaveLen(1))
-		Expect(v2[0].Score).To(Equal(3.0))
-		Expect(v2[0].Member).To(Equal("0543"))
+		Expect(client.TTL("s:cpu,dc:x,host:a:16367").Val()).To(BeNumerically("~", storageTTL, time.Second))
+		Expect(client.TTL("s:cpu,dc:x,host:b:16367").Val()).To(BeNumerically("~", storageTTL, time.Second))
+
+		Expect(client.SMembers("md:cpu:16367").Val()).To(ConsistOf([]string{"s:cpu,dc:x,host:a:16367", "s:cpu,dc:x,host:b:16367"}))
+		Expect(client.SMembers("td:host:a:16367").Val()).To(ConsistOf([]string{"s:cpu,dc:x,host:a:16367"}))
+		Expect(client.SMembers("td:host:b:16367").Val()).To(ConsistOf([]string{"s:cpu,dc:x,host:b:16367"}))
+		Expect(client.SMembers("td:dc:x:16367").Val()).To(ConsistOf([]string{"s:cpu,dc:x,host:a:16367", "s:cpu,dc:x,host:b:16367"}))
+
+		Expect(client.HGetAll("s:cpu,dc:x,host:a:16367").Val()).To(Equal(map[string]string{"0543": "5"}))
+		Expect(client.HGetAll("s:cpu,dc:x,host:b:16367").Val()).To(Equal(map[string]string{"0543": "3"}))
 	})
 
 	It("should scope keys", func() {
@@ -122,22 +120,223 @@ var _ = Describe("DB", func() {
 
 		for _, test := range tests {
 			from, until := unixTimestamp(test.from), unixTimestamp(1515151515)
-			keys, err := subject.scopeKeys(context.Background(), test.met, test.tags, from, until)
+			filter := (&Criteria{Tags: test.tags}).getFilter()
+			keys, err := subject.scopeKeys(context.Background(), test.met, filter, from, until)
 			Expect(err).NotTo(HaveOccurred(), "for %+v", test)
 			Expect(keys.Slice()).To(Equal(test.res), "for %+v", test)
 		}
 	})
 
-	It("should query results", func() {
+	It("should scope keys by tag filter", func() {
+		subject.Set([]Point{
+			point("cpu,a,b 1414141414 1"),
+			point("cpu,a,c 1414141414 1"),
+			point("cpu,b,c 1414141414 1"),
+			point("cpu,d 1414141414 1"),
+			point("mem,a,b 1414141414 1"),
+		})
+
+		tests := []struct {
+			tags   []string
+			filter TagFilter
+			res    []string
+		}{
+			{nil, AllOf(Tag("a"), Tag("b")), []string{"s:cpu,a,b:16367"}},
+			{nil, AnyOf(Tag("a"), Tag("d")), []string{"s:cpu,a,b:16367", "s:cpu,a,c:16367", "s:cpu,d:16367"}},
+			{nil, NoneOf(Tag("c")), []string{"s:cpu,a,b:16367", "s:cpu,d:16367"}},
+			{nil, AnyOf(AllOf(Tag("a"), Tag("b")), NoneOf(Tag("a"))), []string{"s:cpu,a,b:16367", "s:cpu,b,c:16367", "s:cpu,d:16367"}},
+			{nil, AllOf(Tag("a"), Tag("x")), []string{}},
+			{nil, NoneOf(Tag("x")), []string{"s:cpu,a,b:16367", "s:cpu,a,c:16367", "s:cpu,b,c:16367", "s:cpu,d:16367"}},
+			{[]string{"a", "d"}, NoneOf(Tag("b")), []string{"s:cpu,a,c:16367", "s:cpu,d:16367"}},
+		}
+
+		for _, test := range tests {
+			from, until := unixTimestamp(1414141400), unixTimestamp(1515151515)
+			filter := (&Criteria{Tags: test.tags, Filter: test.filter}).getFilter()
+			keys, err := subject.scopeKeys(context.Background(), "cpu", filter, from, until)
+			Expect(err).NotTo(HaveOccurred(), "for %+v", test)
+			Expect(keys.Slice()).To(Equal(test.res), "for %+v", test)
+		}
+	})
+
+	It("should compact", func() {
 		subject.Set([]Point{
-			point("cpu,a,b 1414141200 1"),  // 2014-10-24T09:00:00Z
-			point("cpu,a,c 1414141300 2"),  // 2014-10-24T09:01:40Z
-			point("cpu,a,c 1414142000 4"),  // 2014-10-24T09:13:20Z
-			point("cpu,b,c 1414146000 8"),  // 2014-10-24T10:20:00Z
-			point("cpu,a,b 1414200000 16"), // 2014-10-25T01:20:00Z
-			point("cpu,b,c 1414230000 32"), // 2014-10-25T09:40:00Z
-			point("mem,a,c 1414141200 64"),
+			point("cpu,a,b 1414141414 1"),
+			point("cpu,a,c 1818181818 2"),
+			point("cpu,b,c 1414141414 4"),
+			point("cpu,a,c 1818181818 8"),
+			point("mem,a,c 1414141414 16"),
+		})
+
+		Expect(client.Keys("*").Val()).To(ConsistOf([]string{
+			"s:cpu,a,b:16367",
+			"s:cpu,b,c:16367",
+			"s:cpu,a,c:21043",
+			"s:mem,a,c:16367",
+			"md:cpu:16367",
+			"md:cpu:21043",
+			"md:mem:16367",
+			"td:a:16367",
+			"td:a:21043",
+			"td:b:16367",
+			"td:c:16367",
+			"td:c:21043",
+			"ml:cpu",
+			"ml:mem",
+			"tl:a",
+			"tl:b",
+			"tl:c",
+		}))
+		subject.now = fixedClock("2015-01-01T00:00:00Z")
+		Expect(subject.Compact(context.Background())).NotTo(HaveOccurred())
+		Expect(client.Keys("*").Val()).To(ConsistOf([]string{
+			"s:cpu,a,b:16367",
+			"s:cpu,b,c:16367",
+			"s:cpu,a,c:21043",
+			"s:mem,a,c:16367",
+			"md:cpu:21043",
+			"td:a:21043",
+			"td:c:21043",
+			"ml:cpu",
+			"tl:a",
+			"tl:c",
+		}))
+		Expect(client.ZRange("ml:cpu", 0, -1).Val()).To(Equal([]string{"21043"}))
+	})
+
+	It("should compact fully", func() {
+		points := make([]Point, 0, 301)
+		for i := 0; i < 300; i++ {
+			points = append(points, point(fmt.Sprintf("cpu,a,n:%d 1414141414 1", i)))
+		}
+		points = append(points, point("cpu,a 1818181818 1"))
+		Expect(subject.Set(points)).To(Succeed())
+
+		subject.now = fixedClock("2015-01-01T00:00:00Z")
+		stats, err := subject.CompactFull(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(stats).To(Equal(&CompactStats{KeysScanned: 304, MembersRemoved: 900, Wrapped: true}))
+		Expect(client.Keys("[mt]d:*").Val()).To(ConsistOf([]string{"md:cpu:21043", "td:a:21043"}))
+		Expect(client.SMembers("md:cpu:21043").Val()).To(ConsistOf([]string{"s:cpu,a:21043"}))
+		Expect(client.SMembers("td:a:21043").Val()).To(ConsistOf([]string{"s:cpu,a:21043"}))
+
+		stats, err = subject.CompactFull(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(stats).To(Equal(&CompactStats{KeysScanned: 2, Wrapped: true}))
+	})
+
+	It("should report compaction progress", func() {
+		Expect(subject.Set([]Point{point("cpu,a 1414141414 1")})).To(Succeed())
+
+		subject.now = fixedClock("2015-01-01T00:00:00Z")
+		Expect(subject.store.CompactIndex(context.Background(), func(string) (bool, error) {
+			return true, nil
+		}, false)).To(Equal(&CompactStats{KeysScanned: 2, MembersRemoved: 2, Wrapped: true}))
+	})
+
+	It("should run compactor", func() {
+		Expect(subject.Set([]Point{point("cpu,a 1414141414 1")})).To(Succeed())
+		subject.now = fixedClock("2015-01-01T00:00:00Z")
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error, 1)
+		go func() { done <- subject.RunCompactor(ctx, 10*time.Millisecond, nil) }()
+
+		Eventually(func() []string { return client.Keys("[mt]d:*").Val() }).Should(BeEmpty())
+		cancel()
+		Eventually(done).Should(Receive(Equal(context.Canceled)))
+	})
+
+	It("should keep running compactor on errors", func() {
+		failing := NewDBWithOptions(&redis.Options{Addr: "127.0.0.1:1"})
+		defer failing.Close()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		errs := make(chan error, 10)
+		done := make(chan error, 1)
+		go func() {
+			done <- failing.RunCompactor(ctx, 10*time.Millisecond, func(err error) {
+				select {
+				case errs <- err:
+				default:
+				}
+			})
+		}()
+
+		Eventually(func() int { return len(errs) }).Should(BeNumerically(">=", 2))
+		cancel()
+		Eventually(done).Should(Receive(Equal(context.Canceled)))
+	})
+
+})
+
+var _ = Describe("DB with Redis storage", func() {
+	var client *redis.Client
+
+	AfterEach(func() {
+		closeTestDB(client)
+	})
+
+	sharedDBExamples(func() Storage {
+		client = redis.NewClient(&redis.Options{Addr: "localhost:6379", DB: 9})
+		return NewRedisStorage(client)
+	})
+})
+
+// sharedDBExamples defines the behavioural specs which every storage
+// back-end must satisfy. A new storage is created before each spec.
+func sharedDBExamples(newStorage func() Storage) {
+	var subject *DB
+
+	BeforeEach(func() {
+		subject = New(newStorage())
+		subject.now = fixedClock("2014-10-25T00:00:00Z")
+	})
+
+	AfterEach(func() {
+		Expect(subject.Close()).To(Succeed())
+	})
+
+	It("should set", func() {
+		Expect(subject.Set([]Point{
+			point("cpu,host:a,dc:x 1414141414 2"),
+			point("cpu,dc:x,host:a 1414141414 4"),
+			point("cpu,host:b,dc:x 1414141414 3"),
+			point("cpu,host:a,dc:x 1414141414 1"),
+		})).To(Succeed())
+
+		points, err := subject.QueryPoints(context.Background(), &Criteria{
+			Metric: "cpu",
+			From:   xmltime("2014-10-24T09:00:00Z"),
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(points).To(ConsistOf([]Point{
+			point("cpu,dc:x,host:a 1414141380 1"),
+			point("cpu,dc:x,host:b 1414141380 3"),
+		}))
+	})
+
+	It("should increment", func() {
+		Expect(subject.Increment([]Point{
+			point("cpu,host:a,dc:x 1414141414 2"),
+			point("cpu,dc:x,host:a 1414141414 4"),
+			point("cpu,host:b,dc:x 1414141414 3"),
+			point("cpu,host:a,dc:x 1414141414 -1"),
+		})).To(Succeed())
+
+		points, err := subject.QueryPoints(context.Background(), &Criteria{
+			Metric: "cpu",
+			From:   xmltime("2014-10-24T09:00:00Z"),
 		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(points).To(ConsistOf([]Point{
+			point("cpu,dc:x,host:a 1414141380 5"),
+			point("cpu,dc:x,host:b 1414141380 3"),
+		}))
+	})
+
+	It("should query results", func() {
+		Expect(subject.Set(append(cpuPoints(), point("mem,a,c 1414141200 64")))).To(Succeed())
 
 		tests := []struct {
 			crit Criteria
@@ -145,43 +344,43 @@ var _ = Describe("DB", func() {
 		}{
 			// from 09:00 until open end, by hour
 			{Criteria{Metric: "cpu", From: xmltime("2014-10-24T09:00:00Z"), Interval: time.Hour}, ResultSet{
-				{xmltime("2014-10-24T09:00:00Z"), 7},
-				{xmltime("2014-10-24T10:00:00Z"), 8},
-				{xmltime("2014-10-25T01:00:00Z"), 16},
-				{xmltime("2014-10-25T09:00:00Z"), 32},
+				{xmltime("2014-10-24T09:00:00Z"), 7, xmltime("2014-10-24T10:00:00Z")},
+				{xmltime("2014-10-24T10:00:00Z"), 8, xmltime("2014-10-24T11:00:00Z")},
+				{xmltime("2014-10-25T01:00:00Z"), 16, xmltime("2014-10-25T02:00:00Z")},
+				{xmltime("2014-10-25T09:00:00Z"), 32, xmltime("2014-10-25T10:00:00Z")},
 			}},
 			// from 10:00 until open end, by day
 			{Criteria{Metric: "cpu", From: xmltime("2014-10-24T10:00:00Z"), Interval: 24 * time.Hour}, ResultSet{
-				{xmltime("2014-10-24T00:00:00Z"), 8},
-				{xmltime("2014-10-25T00:00:00Z"), 48},
+				{xmltime("2014-10-24T00:00:00Z"), 8, xmltime("2014-10-25T00:00:00Z")},
+				{xmltime("2014-10-25T00:00:00Z"), 48, xmltime("2014-10-26T00:00:00Z")},
 			}},
 			// between 09:00 and 09:10, by minute
 			{Criteria{Metric: "cpu", From: xmltime("2014-10-24T09:00:00Z"), Until: xmltime("2014-10-24T09:10:00Z"), Interval: time.Minute}, ResultSet{
-				{xmltime("2014-10-24T09:00:00Z"), 1},
-				{xmltime("2014-10-24T09:01:00Z"), 2},
+				{xmltime("2014-10-24T09:00:00Z"), 1, xmltime("2014-10-24T09:01:00Z")},
+				{xmltime("2014-10-24T09:01:00Z"), 2, xmltime("2014-10-24T09:02:00Z")},
 			}},
 			// between 08:59 and 09:01, by minute
 			{Criteria{Metric: "cpu", From: xmltime("2014-10-24T08:59:00Z"), Until: xmltime("2014-10-24T09:01:00Z"), Interval: time.Minute}, ResultSet{
-				{xmltime("2014-10-24T09:00:00Z"), 1},
-				{xmltime("2014-10-24T09:01:00Z"), 2},
+				{xmltime("2014-10-24T09:00:00Z"), 1, xmltime("2014-10-24T09:01:00Z")},
+				{xmltime("2014-10-24T09:01:00Z"), 2, xmltime("2014-10-24T09:02:00Z")},
 			}},
 			// between 09:01 and 09:03, by minute
 			{Criteria{Metric: "cpu", From: xmltime("2014-10-24T09:01:00Z"), Until: xmltime("2014-10-24T09:03:00Z"), Interval: time.Minute}, ResultSet{
-				{xmltime("2014-10-24T09:01:00Z"), 2},
+				{xmltime("2014-10-24T09:01:00Z"), 2, xmltime("2014-10-24T09:02:00Z")},
 			}},
 			// between 09:00 and 09:12:59, by 10-mins
 			{Criteria{Metric: "cpu", From: xmltime("2014-10-24T09:00:00Z"), Until: xmltime("2014-10-24T09:12:59Z"), Interval: 10 * time.Minute}, ResultSet{
-				{xmltime("2014-10-24T09:00:00Z"), 3},
+				{xmltime("2014-10-24T09:00:00Z"), 3, xmltime("2014-10-24T09:10:00Z")},
 			}},
 			// between 09:00 and 09:12:59, by 10-mins
 			{Criteria{Metric: "cpu", From: xmltime("2014-10-24T09:00:00Z"), Until: xmltime("2014-10-24T09:13:00Z"), Interval: 10 * time.Minute}, ResultSet{
-				{xmltime("2014-10-24T09:00:00Z"), 3},
-				{xmltime("2014-10-24T09:10:00Z"), 4},
+				{xmltime("2014-10-24T09:00:00Z"), 3, xmltime("2014-10-24T09:10:00Z")},
+				{xmltime("2014-10-24T09:10:00Z"), 4, xmltime("2014-10-24T09:20:00Z")},
 			}},
 
 			// tagged with 'a' between 09:00 and 11:00, by hour
 			{Criteria{Metric: "cpu", From: xmltime("2014-10-24T09:00:00Z"), Until: xmltime("2014-10-24T11:00:00Z"), Tags: []string{"a"}, Interval: time.Hour}, ResultSet{
-				{xmltime("2014-10-24T09:00:00Z"), 7},
+				{xmltime("2014-10-24T09:00:00Z"), 7, xmltime("2014-10-24T10:00:00Z")},
 			}},
 
 			// `from` is after the last point
@@ -197,6 +396,74 @@ var _ = Describe("DB", func() {
 		}
 	})
 
+	It("should query grouped", func() {
+		subject.Set([]Point{
+			point("cpu,dc:x,host:a 1414141200 1"), // 2014-10-24T09:00:00Z
+			point("cpu,dc:x,host:b 1414141300 2"), // 2014-10-24T09:01:40Z
+			point("cpu,dc:y,host:a 1414142000 4"), // 2014-10-24T09:13:20Z
+			point("cpu,host:b 1414146000 8"),      // 2014-10-24T10:20:00Z
+			point("mem,dc:x,host:a 1414141200 64"),
+		})
+
+		groups, err := subject.QueryGrouped(context.Background(), &Criteria{
+			Metric:   "cpu",
+			From:     xmltime("2014-10-24T09:00:00Z"),
+			Interval: time.Hour,
+			GroupBy:  []string{"host:"},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(groups).To(Equal([]Group{
+			{Tags: []string{"host:a"}, Results: ResultSet{{xmltime("2014-10-24T09:00:00Z"), 5, xmltime("2014-10-24T10:00:00Z")}}},
+			{Tags: []string{"host:b"}, Results: ResultSet{{xmltime("2014-10-24T09:00:00Z"), 2, xmltime("2014-10-24T10:00:00Z")}, {xmltime("2014-10-24T10:00:00Z"), 8, xmltime("2014-10-24T11:00:00Z")}}},
+		}))
+
+		groups, err = subject.QueryGrouped(context.Background(), &Criteria{
+			Metric:   "cpu",
+			From:     xmltime("2014-10-24T09:00:00Z"),
+			Interval: 24 * time.Hour,
+			GroupBy:  []string{"dc:", "host:"},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(groups).To(Equal([]Group{
+			{Tags: []string{"", "host:b"}, Results: ResultSet{{xmltime("2014-10-24T00:00:00Z"), 8, xmltime("2014-10-25T00:00:00Z")}}},
+			{Tags: []string{"dc:x", "host:a"}, Results: ResultSet{{xmltime("2014-10-24T00:00:00Z"), 1, xmltime("2014-10-25T00:00:00Z")}}},
+			{Tags: []string{"dc:x", "host:b"}, Results: ResultSet{{xmltime("2014-10-24T00:00:00Z"), 2, xmltime("2014-10-25T00:00:00Z")}}},
+			{Tags: []string{"dc:y", "host:a"}, Results: ResultSet{{xmltime("2014-10-24T00:00:00Z"), 4, xmltime("2014-10-25T00:00:00Z")}}},
+		}))
+
+		groups, err = subject.QueryGrouped(context.Background(), &Criteria{
+			Metric: "cpu",
+			From:   xmltime("2014-10-24T09:00:00Z"),
+			Until:  xmltime("2014-10-24T09:05:00Z"),
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(groups).To(Equal([]Group{
+			{Tags: []string{}, Results: ResultSet{{xmltime("2014-10-24T09:00:00Z"), 1, xmltime("2014-10-24T09:01:00Z")}, {xmltime("2014-10-24T09:01:00Z"), 2, xmltime("2014-10-24T09:02:00Z")}}},
+		}))
+	})
+
+	It("should group by plain tag prefixes", func() {
+		subject.Set([]Point{
+			point("cpu,host:a 1414141200 1"),
+			point("cpu,host:ab 1414141200 2"),
+			point("cpu,host:b 1414141200 4"),
+		})
+
+		// host:a is a prefix of host:ab, not a tag
+		groups, err := subject.QueryGrouped(context.Background(), &Criteria{
+			Metric:   "cpu",
+			From:     xmltime("2014-10-24T00:00:00Z"),
+			Interval: 24 * time.Hour,
+			GroupBy:  []string{"host:a"},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(groups).To(Equal([]Group{
+			{Tags: []string{""}, Results: ResultSet{{xmltime("2014-10-24T00:00:00Z"), 4, xmltime("2014-10-25T00:00:00Z")}}},
+			{Tags: []string{"host:a"}, Results: ResultSet{{xmltime("2014-10-24T00:00:00Z"), 1, xmltime("2014-10-25T00:00:00Z")}}},
+			{Tags: []string{"host:ab"}, Results: ResultSet{{xmltime("2014-10-24T00:00:00Z"), 2, xmltime("2014-10-25T00:00:00Z")}}},
+		}))
+	})
+
 	It("should query with context", func() {
 		subject.Set([]Point{point("cpu,a,b 1414141200 1")})
 
@@ -259,40 +526,7 @@ var _ = Describe("DB", func() {
 			point("cpu.1h,b,c 1414144800 8"), // 2014-10-24T10:00:00Z
 		}))
 	})
-
-	It("should compact", func() {
-		subject.Set([]Point{
-			point("cpu,a,b 1414141414 1"),
-			point("cpu,a,c 1818181818 2"),
-			point("cpu,b,c 1414141414 4"),
-			point("cpu,a,c 1818181818 8"),
-			point("mem,a,c 1414141414 16"),
-		})
-
-		Expect(subject.client.Keys("*").Val()).To(ConsistOf([]string{
-			"s:cpu,a,b:16367",
-			"s:cpu,b,c:16367",
-			"s:cpu,a,c:21043",
-			"s:mem,a,c:16367",
-			"m:cpu",
-			"m:mem",
-			"t:a",
-			"t:b",
-			"t:c",
-		}))
-		Expect(subject.Compact(context.Background())).NotTo(HaveOccurred())
-		Expect(subject.client.Keys("*").Val()).To(ConsistOf([]string{
-			"s:cpu,a,b:16367",
-			"s:cpu,b,c:16367",
-			"s:cpu,a,c:21043",
-			"s:mem,a,c:16367",
-			"m:cpu",
-			"t:a",
-			"t:c",
-		}))
-	})
-
-})
+}
 
 func benchWrites(b *testing.B, batchSize int, tagsMap map[string]int) {
 	// Set batch size
@@ -312,7 +546,8 @@ func benchWrites(b *testing.B, batchSize int, tagsMap map[string]int) {
 
 	// Connect
 	client := NewDB("127.0.0.1:6379", 9)
-	defer client.client.FlushDb()
+	client.now = fixedClock("2014-10-25T00:00:00Z")
+	defer client.store.(*RedisStorage).client.(*redis.Client).FlushDb()
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i += batchSize {
@@ -351,7 +586,8 @@ func BenchmarkSet_100Metrics_LargeBatches(b *testing.B) {
 
 func BenchmarkQuery_Parallel(b *testing.B) {
 	client := NewDB("127.0.0.1:6379", 9)
-	defer client.client.FlushDb()
+	client.now = fixedClock("2014-10-25T00:00:00Z")
+	defer client.store.(*RedisStorage).client.(*redis.Client).FlushDb()
 
 	err := client.Set([]Point{
 		point("cpu,a,b 1414141414 1"),
@@ -0,0 +1,302 @@
+package cntdb
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/bsm/strset"
+)
+
+var (
+	errMissingMetric = errors.New("cntdb: criteria require a metric")
+	errMissingFrom   = errors.New("cntdb: criteria require a start time")
+)
+
+// bounds of deletions which are not restricted in time
+var (
+	minTimestamp = unixTimestamp(-1 << 40)
+	maxTimestamp = unixTimestamp(1 << 40)
+)
+
+// DeleteStats reports data removed by a Deleter.
+type DeleteStats struct {
+	Keys   int // number of removed series keys, one per series and day
+	Values int // number of removed minute values
+}
+
+func (s *DeleteStats) add(o *DeleteStats) {
+	s.Keys += o.Keys
+	s.Values += o.Values
+}
+
+// Deleter removes data from a DB.
+type Deleter struct {
+	db     *DB
+	dryRun bool
+}
+
+// DryRun returns a Deleter which does not remove any data, but reports
+// what would have been removed.
+func (b *DB) DryRun() *Deleter {
+	return &Deleter{db: b, dryRun: true}
+}
+
+// Delete removes data matching the criteria, see Deleter.Delete.
+func (b *DB) Delete(ctx context.Context, c *Criteria) (*DeleteStats, error) {
+	return (&Deleter{db: b}).Delete(ctx, c)
+}
+
+// DropMetric removes all data of a metric, see Deleter.DropMetric.
+func (b *DB) DropMetric(ctx context.Context, metric string) (*DeleteStats, error) {
+	return (&Deleter{db: b}).DropMetric(ctx, metric)
+}
+
+// DropTag removes all data of a tag, see Deleter.DropTag.
+func (b *DB) DropTag(ctx context.Context, tag string) (*DeleteStats, error) {
+	return (&Deleter{db: b}).DropTag(ctx, tag)
+}
+
+// Delete removes the values of all series matching the criteria between
+// From and Until. A start time, either From or FromAgo, is required, Until
+// defaults to now. Series without remaining values are removed from the
+// index. Rollup tiers of the metric are adjusted: fully covered tier
+// buckets are removed, partially covered ones are reduced by the removed
+// values.
+func (d *Deleter) Delete(ctx context.Context, c *Criteria) (*DeleteStats, error) {
+	if c == nil || c.Metric == "" {
+		return nil, errMissingMetric
+	} else if c.From.IsZero() && c.FromAgo == 0 {
+		return nil, errMissingFrom
+	}
+
+	b := d.db
+	from, until, filter := c.getFrom(), c.getUntil(), c.getFilter()
+
+	// tier metrics are validated before anything is removed
+	tiers := b.rollups.tiers
+	if _, ok := b.rollups.tierOf(c.Metric); ok {
+		tiers = nil
+	}
+	for _, tier := range tiers {
+		if _, err := NewPointAt(tier.Metric(c.Metric), nil, from.Time, 0); err != nil {
+			return nil, err
+		}
+	}
+	keys, err := b.scopeKeys(ctx, c.Metric, filter, from, until)
+	if err != nil {
+		return nil, err
+	}
+
+	var removed []Point
+	stats, err := d.remove(ctx, keys.Slice(), from, until, func(s series, ts time.Time, val int64) error {
+		point, err := NewPointAt(s.metric, s.tags, ts, val)
+		if err != nil {
+			return err
+		}
+		removed = append(removed, point)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	f, u := from.Truncate(time.Minute), until.Truncate(time.Minute)
+	for _, tier := range tiers {
+		metric := tier.Metric(c.Metric)
+
+		// first and (exclusive) last fully covered tier bucket
+		a := f.Truncate(tier.Interval)
+		if a.Before(f) {
+			a = a.Add(tier.Interval)
+		}
+		z := u.Add(time.Minute).Truncate(tier.Interval)
+
+		if a.Before(z) {
+			ta, tz := timestamp{a}, timestamp{z.Add(-time.Minute)}
+			keys, err := b.scopeKeys(ctx, metric, filter, ta, tz)
+			if err != nil {
+				return nil, err
+			}
+			sub, err := d.remove(ctx, keys.Slice(), ta, tz, nil)
+			if err != nil {
+				return nil, err
+			}
+			stats.add(sub)
+		}
+
+		if err := d.reduce(ctx, tier, a, z, removed); err != nil {
+			return nil, err
+		}
+	}
+	return stats, nil
+}
+
+// DropMetric removes all series of a metric, including its rollup tiers.
+func (d *Deleter) DropMetric(ctx context.Context, metric string) (*DeleteStats, error) {
+	b := d.db
+	metrics := []string{metric}
+	if _, ok := b.rollups.tierOf(metric); !ok {
+		for _, tier := range b.rollups.tiers {
+			metrics = append(metrics, tier.Metric(metric))
+		}
+	}
+
+	keys := strset.New(10)
+	for _, metric := range metrics {
+		sub, err := b.scanIndex(ctx, "m:"+metric, minTimestamp.UnixDay(), maxTimestamp.UnixDay())
+		if err != nil {
+			return nil, err
+		}
+		keys = keys.Union(sub)
+	}
+
+	stats, err := d.remove(ctx, keys.Slice(), minTimestamp, maxTimestamp, nil)
+	if err != nil || d.dryRun {
+		return stats, err
+	}
+	if err := b.dropMarkers(ctx, metric); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// DropTag removes all series with a tag, across all metrics and rollup
+// tiers.
+func (d *Deleter) DropTag(ctx context.Context, tag string) (*DeleteStats, error) {
+	keys, err := d.db.scanIndex(ctx, "t:"+tag, minTimestamp.UnixDay(), maxTimestamp.UnixDay())
+	if err != nil {
+		return nil, err
+	}
+	return d.remove(ctx, keys.Slice(), minTimestamp, maxTimestamp, nil)
+}
+
+// removes values of series keys between from and until, calls fn for each
+// removed value
+func (d *Deleter) remove(ctx context.Context, keys []string, from, until timestamp, fn func(series, time.Time, int64) error) (*DeleteStats, error) {
+	min, max := from.Truncate(time.Minute), until.Truncate(time.Minute)
+
+	type state struct {
+		series  series
+		minutes []int // minutes within range
+		total   int   // number of stored minutes
+	}
+
+	// full days are read to find keys which are emptied
+	states := make(map[string]*state, len(keys))
+	ranges := make([]SeriesRange, 0, len(keys))
+	for _, key := range keys {
+		ser, err := parseSeries(key)
+		if err != nil {
+			return nil, err
+		}
+		states[key] = &state{series: ser}
+		ranges = append(ranges, FullDay(key))
+	}
+
+	if err := d.db.store.ReadSeries(ctx, ranges, func(key string, minute int, value int64) error {
+		st := states[key]
+		st.total++
+
+		ts := st.series.StartTime().Add(time.Duration(minute) * time.Minute)
+		if ts.Before(min) || ts.After(max) {
+			return nil
+		}
+		st.minutes = append(st.minutes, minute)
+
+		if fn != nil {
+			return fn(st.series, ts, value)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	stats := new(DeleteStats)
+	removals := make([]Removal, 0, len(states))
+	for key, st := range states {
+		start := st.series.StartTime()
+		covered := !start.Before(min) && !start.Add(24*time.Hour-time.Minute).After(max)
+		if !covered && len(st.minutes) == 0 {
+			continue
+		}
+
+		stats.Values += len(st.minutes)
+		if len(st.minutes) != 0 && len(st.minutes) == st.total {
+			stats.Keys++
+		}
+
+		rem := Removal{Key: key, Index: seriesIndex(st.series.metric, st.series.tags)}
+		if !covered {
+			rem.Minutes = st.minutes
+		}
+		removals = append(removals, rem)
+	}
+
+	if d.dryRun || len(removals) == 0 {
+		return stats, nil
+	}
+	return stats, d.db.store.Remove(ctx, removals)
+}
+
+// reduces tier buckets outside of the fully covered range a..z by the
+// removed raw values, buckets which have not been rolled up are skipped
+func (d *Deleter) reduce(ctx context.Context, tier Tier, a, z time.Time, removed []Point) error {
+	acc := make(map[string]Point)
+	for _, pt := range removed {
+		start := pt.timestamp.Truncate(tier.Interval)
+		if !start.Before(a) && start.Before(z) {
+			continue
+		}
+
+		point, err := NewPointAt(tier.Metric(pt.metric), pt.tags, start, -pt.count)
+		if err != nil {
+			return err
+		}
+		if ex, ok := acc[point.uID()]; ok {
+			point.count += ex.count
+		}
+		acc[point.uID()] = point
+	}
+	if len(acc) == 0 || d.dryRun {
+		return nil
+	}
+
+	keys := strset.New(len(acc))
+	for _, point := range acc {
+		keys.Add(point.keyName())
+	}
+
+	// reduce values, remove buckets which are reduced to zero
+	var points []Point
+	var removals []Removal
+	if err := d.db.scanSeries(ctx, keys.Slice(), minTimestamp, maxTimestamp, func(s series, ts time.Time, val int64) error {
+		point, err := NewPointAt(s.metric, s.tags, ts, 0)
+		if err != nil {
+			return err
+		}
+
+		pt, ok := acc[point.uID()]
+		if !ok {
+			return nil
+		} else if val+pt.count != 0 {
+			points = append(points, pt)
+			return nil
+		}
+		removals = append(removals, Removal{
+			Key:     pt.keyName(),
+			Minutes: []int{int(pt.timestamp.MinuteOfDay())},
+			Index:   seriesIndex(s.metric, s.tags),
+		})
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	if len(removals) != 0 {
+		if err := d.db.store.Remove(ctx, removals); err != nil {
+			return err
+		}
+	}
+	return d.db.Increment(points)
+}
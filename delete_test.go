@@ -0,0 +1,154 @@
+package cntdb
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-redis/redis"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Deleter", func() {
+	var subject *DB
+	var client *redis.Client
+
+	hourly := Tier{Interval: time.Hour, Retention: 100 * 24 * time.Hour}
+	daily := Tier{Interval: 24 * time.Hour, Retention: 400 * 24 * time.Hour}
+
+	query := func(c *Criteria) ResultSet {
+		res, err := subject.Query(context.Background(), c)
+		Expect(err).NotTo(HaveOccurred())
+		return res
+	}
+
+	BeforeEach(func() {
+		subject, client = openTestDB("2014-10-20T12:00:00Z")
+		Expect(subject.SetRollups(hourly, daily)).To(Succeed())
+		subject.now = fixedClock("2014-10-26T12:00:00Z")
+
+		Expect(subject.Increment(append(cpuPoints(),
+			point("cpu,b,c 1414317600 64"), // 2014-10-26T10:00:00Z
+			point("mem,a 1414141200 128"),  // 2014-10-24T09:00:00Z
+		))).To(Succeed())
+	})
+
+	AfterEach(func() {
+		closeTestDB(client)
+	})
+
+	It("should require a metric", func() {
+		_, err := subject.Delete(context.Background(), &Criteria{Tags: []string{"a"}})
+		Expect(err).To(Equal(errMissingMetric))
+	})
+
+	It("should require a start time", func() {
+		_, err := subject.Delete(context.Background(), &Criteria{Metric: "cpu"})
+		Expect(err).To(Equal(errMissingFrom))
+		Expect(client.Keys("s:cpu,*").Val()).To(HaveLen(6))
+	})
+
+	It("should validate tier metrics before removing", func() {
+		metric := "cpu.with.a.very.long.name.close.to.the.limits"
+		Expect(subject.Increment([]Point{point(metric + ",a 1414141200 1")})).To(Succeed())
+
+		_, err := subject.Delete(context.Background(), &Criteria{
+			Metric: metric,
+			From:   xmltime("2014-10-24T00:00:00Z"),
+		})
+		Expect(err).To(Equal(errInvalidMetric))
+		Expect(client.Exists("s:" + metric + ",a:16367").Val()).To(Equal(int64(1)))
+	})
+
+	It("should delete ranges", func() {
+		Expect(subject.Delete(context.Background(), &Criteria{
+			Metric: "cpu",
+			Tags:   []string{"a"},
+			From:   xmltime("2014-10-24T09:00:00Z"),
+			Until:  xmltime("2014-10-24T09:05:00Z"),
+		})).To(Equal(&DeleteStats{Keys: 1, Values: 2}))
+
+		Expect(client.Exists("s:cpu,a,b:16367").Val()).To(BeZero())
+		Expect(client.HGetAll("s:cpu,a,c:16367").Val()).To(Equal(map[string]string{"0553": "4"}))
+		Expect(indexMembers(client, "t:b")).To(ConsistOf([]string{"s:cpu,b,c:16367", "s:cpu,a,b:16368", "s:cpu,b,c:16368", "s:cpu,b,c:16369"}))
+		Expect(indexMembers(client, "t:a")).To(ConsistOf([]string{"s:cpu,a,c:16367", "s:cpu,a,b:16368", "s:mem,a:16367"}))
+	})
+
+	It("should delete whole days", func() {
+		Expect(subject.Delete(context.Background(), &Criteria{
+			Metric: "cpu",
+			From:   xmltime("2014-10-25T00:00:00Z"),
+			Until:  xmltime("2014-10-25T23:59:59Z"),
+		})).To(Equal(&DeleteStats{Keys: 2, Values: 2}))
+
+		Expect(client.Keys("s:cpu,*:16368").Val()).To(BeEmpty())
+		Expect(indexMembers(client, "m:cpu")).To(ConsistOf([]string{"s:cpu,a,b:16367", "s:cpu,a,c:16367", "s:cpu,b,c:16367", "s:cpu,b,c:16369"}))
+	})
+
+	It("should drop metrics", func() {
+		Expect(subject.Rollup(context.Background())).To(Succeed())
+		Expect(subject.DropMetric(context.Background(), "cpu")).To(Equal(&DeleteStats{Keys: 18, Values: 19}))
+		Expect(client.Keys("*").Val()).To(ConsistOf([]string{
+			"s:mem,a:16367",
+			"s:mem@60m,a:16367",
+			"s:mem@1440m,a:16367",
+			"md:mem:16367",
+			"md:mem@60m:16367",
+			"md:mem@1440m:16367",
+			"td:a:16367",
+			"s:mem@written:16367",
+			"s:mem@rolled:16367",
+			"md:@rollup:16367",
+			"meta:rollups",
+			"ml:mem",
+			"ml:mem@60m",
+			"ml:mem@1440m",
+			"ml:@rollup",
+			"tl:a",
+		}))
+	})
+
+	It("should drop tags", func() {
+		Expect(subject.DropTag(context.Background(), "a")).To(Equal(&DeleteStats{Keys: 4, Values: 5}))
+		Expect(indexMembers(client, "t:a")).To(BeEmpty())
+		Expect(indexMembers(client, "m:cpu")).To(ConsistOf([]string{"s:cpu,b,c:16367", "s:cpu,b,c:16368", "s:cpu,b,c:16369"}))
+		Expect(indexMembers(client, "m:mem")).To(BeEmpty())
+	})
+
+	It("should dry-run", func() {
+		keys := client.Keys("*").Val()
+
+		Expect(subject.DryRun().Delete(context.Background(), &Criteria{
+			Metric: "cpu",
+			Tags:   []string{"a"},
+			From:   xmltime("2014-10-24T09:00:00Z"),
+			Until:  xmltime("2014-10-24T09:05:00Z"),
+		})).To(Equal(&DeleteStats{Keys: 1, Values: 2}))
+		Expect(subject.DryRun().DropMetric(context.Background(), "cpu")).To(Equal(&DeleteStats{Keys: 6, Values: 7}))
+		Expect(subject.DryRun().DropTag(context.Background(), "a")).To(Equal(&DeleteStats{Keys: 4, Values: 5}))
+		Expect(client.Keys("*").Val()).To(ConsistOf(keys))
+	})
+
+	It("should adjust rollup tiers", func() {
+		Expect(subject.Rollup(context.Background())).To(Succeed())
+		Expect(subject.Delete(context.Background(), &Criteria{
+			Metric: "cpu",
+			From:   xmltime("2014-10-24T09:10:00Z"),
+			Until:  xmltime("2014-10-25T09:59:00Z"),
+		})).To(Equal(&DeleteStats{Keys: 6, Values: 7}))
+
+		Expect(client.HGetAll("s:cpu@60m,a,c:16367").Val()).To(Equal(map[string]string{"0540": "2"}))
+		Expect(client.HGetAll("s:cpu@1440m,a,c:16367").Val()).To(Equal(map[string]string{"0000": "2"}))
+		Expect(client.Keys("s:cpu@*,b,c:1636[78]").Val()).To(BeEmpty())
+		Expect(client.Keys("s:cpu@*,a,b:16368").Val()).To(BeEmpty())
+
+		Expect(query(&Criteria{Metric: "cpu", From: xmltime("2014-10-24T00:00:00Z"), Until: xmltime("2014-10-27T00:00:00Z"), Interval: 24 * time.Hour})).To(Equal(ResultSet{
+			{xmltime("2014-10-24T00:00:00Z"), 3, xmltime("2014-10-25T00:00:00Z")},
+			{xmltime("2014-10-26T00:00:00Z"), 64, xmltime("2014-10-27T00:00:00Z")},
+		}))
+		Expect(query(&Criteria{Metric: "cpu", From: xmltime("2014-10-24T00:00:00Z"), Until: xmltime("2014-10-25T23:59:00Z"), Interval: time.Hour})).To(Equal(ResultSet{
+			{xmltime("2014-10-24T09:00:00Z"), 3, xmltime("2014-10-24T10:00:00Z")},
+		}))
+	})
+
+})
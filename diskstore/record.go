@@ -0,0 +1,167 @@
+package diskstore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+)
+
+const maxRecordSize = 1 << 20
+
+var errCorrupt = errors.New("diskstore: corrupt record")
+
+const (
+	flagIncr   = 1 << iota
+	flagRemove // removes the minute value
+	flagDrop   // removes the whole key
+)
+
+// record is a single log entry. Records are framed as
+//
+//	[uint32 payload size][uint32 CRC32 of payload][payload]
+//
+// which allows torn writes at the tail of a file to be detected.
+type record struct {
+	flags   byte
+	expires int64 // unix seconds
+	key     string
+	minute  int
+	value   int64
+	index   []string
+}
+
+func (r *record) appendTo(dst []byte) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+
+	pos := len(dst)
+	dst = append(dst, make([]byte, 8)...)
+	dst = append(dst, r.flags)
+	dst = append(dst, tmp[:binary.PutVarint(tmp[:], r.expires)]...)
+	dst = appendString(dst, r.key)
+	dst = append(dst, tmp[:binary.PutUvarint(tmp[:], uint64(r.minute))]...)
+	dst = append(dst, tmp[:binary.PutVarint(tmp[:], r.value)]...)
+	dst = append(dst, tmp[:binary.PutUvarint(tmp[:], uint64(len(r.index)))]...)
+	for _, name := range r.index {
+		dst = appendString(dst, name)
+	}
+
+	payload := dst[pos+8:]
+	binary.BigEndian.PutUint32(dst[pos:], uint32(len(payload)))
+	binary.BigEndian.PutUint32(dst[pos+4:], crc32.ChecksumIEEE(payload))
+	return dst
+}
+
+func appendString(dst []byte, s string) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	dst = append(dst, tmp[:binary.PutUvarint(tmp[:], uint64(len(s)))]...)
+	return append(dst, s...)
+}
+
+// --------------------------------------------------------------------
+
+type recordReader struct {
+	r   *bufio.Reader
+	buf []byte
+	pos int64 // offset after the last valid record
+}
+
+func newRecordReader(r io.Reader) *recordReader {
+	return &recordReader{r: bufio.NewReader(r)}
+}
+
+// Read reads the next record. It returns io.EOF at the clean end of the
+// log and errCorrupt if the remainder of the log cannot be read.
+func (rr *recordReader) Read(rec *record) error {
+	var head [8]byte
+	if _, err := io.ReadFull(rr.r, head[:]); err == io.EOF {
+		return io.EOF
+	} else if err != nil {
+		return errCorrupt
+	}
+
+	size := binary.BigEndian.Uint32(head[:])
+	if size > maxRecordSize {
+		return errCorrupt
+	}
+	if cap(rr.buf) < int(size) {
+		rr.buf = make([]byte, size)
+	}
+	payload := rr.buf[:size]
+	if _, err := io.ReadFull(rr.r, payload); err != nil {
+		return errCorrupt
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(head[4:]) {
+		return errCorrupt
+	}
+	if err := rec.decode(payload); err != nil {
+		return err
+	}
+
+	rr.pos += 8 + int64(size)
+	return nil
+}
+
+func (r *record) decode(p []byte) error {
+	d := decoder{p: p}
+	r.flags = d.byte()
+	r.expires = d.varint()
+	r.key = d.string()
+	r.minute = int(d.uvarint())
+	r.value = d.varint()
+	r.index = make([]string, int(d.uvarint()))
+	for i := range r.index {
+		r.index[i] = d.string()
+	}
+	if d.err || len(d.p) != 0 {
+		return errCorrupt
+	}
+	return nil
+}
+
+type decoder struct {
+	p   []byte
+	err bool
+}
+
+func (d *decoder) byte() byte {
+	if len(d.p) == 0 {
+		d.err = true
+		return 0
+	}
+	b := d.p[0]
+	d.p = d.p[1:]
+	return b
+}
+
+func (d *decoder) varint() int64 {
+	v, n := binary.Varint(d.p)
+	if n <= 0 {
+		d.err = true
+		return 0
+	}
+	d.p = d.p[n:]
+	return v
+}
+
+func (d *decoder) uvarint() uint64 {
+	v, n := binary.Uvarint(d.p)
+	if n <= 0 || v > maxRecordSize {
+		d.err = true
+		return 0
+	}
+	d.p = d.p[n:]
+	return v
+}
+
+func (d *decoder) string() string {
+	n := int(d.uvarint())
+	if d.err || n > len(d.p) {
+		d.err = true
+		return ""
+	}
+	s := string(d.p[:n])
+	d.p = d.p[n:]
+	return s
+}
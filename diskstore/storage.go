@@ -0,0 +1,543 @@
+// Package diskstore implements an embedded, file-based cntdb storage.
+//
+// Series are partitioned by day, each day is stored in a separate append-only
+// log file within the data directory. Logs are replayed into memory on open,
+// torn records at the tail of a log are discarded. Whole days can be dropped
+// by removing their log.
+package diskstore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bsm/cntdb"
+)
+
+var errInvalidKey = errors.New("diskstore: invalid key")
+
+// Options contain optional settings.
+type Options struct {
+	// Sync forces an fsync after each write batch.
+	// Default: false
+	Sync bool
+}
+
+func (o *Options) norm() *Options {
+	var oo Options
+	if o != nil {
+		oo = *o
+	}
+	return &oo
+}
+
+type series struct {
+	values  map[int]int64
+	expires int64 // unix seconds
+}
+
+type partition struct {
+	file    *os.File
+	series  map[string]*series
+	index   map[string]map[string]struct{}
+	expires int64 // unix seconds, latest expiry of all series
+	size    int64 // offset after the last complete record
+	err     error // set if a failed append could not be rolled back
+}
+
+// rollback discards a partially written batch, so that later appends do not
+// follow a torn record. If that fails, the partition refuses further writes.
+func (p *partition) rollback() {
+	if err := p.file.Truncate(p.size); err != nil {
+		p.err = err
+		return
+	}
+	if _, err := p.file.Seek(p.size, io.SeekStart); err != nil {
+		p.err = err
+	}
+}
+
+func (p *partition) apply(rec *record) {
+	if rec.flags&(flagRemove|flagDrop) != 0 {
+		p.remove(rec)
+		return
+	}
+
+	ser, ok := p.series[rec.key]
+	if !ok {
+		ser = &series{values: make(map[int]int64)}
+		p.series[rec.key] = ser
+	}
+	if rec.flags&flagIncr != 0 {
+		ser.values[rec.minute] += rec.value
+	} else {
+		ser.values[rec.minute] = rec.value
+	}
+	ser.expires = rec.expires
+	if rec.expires > p.expires {
+		p.expires = rec.expires
+	}
+
+	for _, name := range rec.index {
+		set, ok := p.index[name]
+		if !ok {
+			set = make(map[string]struct{})
+			p.index[name] = set
+		}
+		set[rec.key] = struct{}{}
+	}
+}
+
+func (p *partition) remove(rec *record) {
+	if ser, ok := p.series[rec.key]; ok {
+		if rec.flags&flagRemove != 0 {
+			delete(ser.values, rec.minute)
+			if len(ser.values) != 0 {
+				return
+			}
+		}
+		delete(p.series, rec.key)
+	}
+
+	for _, name := range rec.index {
+		if set, ok := p.index[name]; ok {
+			delete(set, rec.key)
+			if len(set) == 0 {
+				delete(p.index, name)
+			}
+		}
+	}
+}
+
+// Storage is a file-based implementation of cntdb.Storage.
+type Storage struct {
+	dir  string
+	opt  *Options
+	days map[int64]*partition
+	mu   sync.RWMutex
+}
+
+// Open opens a storage within dir, creating it if necessary.
+func Open(dir string, opt *Options) (*Storage, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	names, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Storage{
+		dir:  dir,
+		opt:  opt.norm(),
+		days: make(map[int64]*partition),
+	}
+	for _, fi := range names {
+		day, ok := parseFileName(fi.Name())
+		if !ok || fi.IsDir() {
+			continue
+		}
+		if _, err := s.partition(day); err != nil {
+			_ = s.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Days returns the days of all stored partitions, in ascending order.
+func (s *Storage) Days() []int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	days := make([]int64, 0, len(s.days))
+	for day := range s.days {
+		days = append(days, day)
+	}
+	sort.Sort(int64Slice(days))
+	return days
+}
+
+// DropDay removes a whole day partition.
+func (s *Storage) DropDay(day int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.drop(day)
+}
+
+// Close closes the storage.
+func (s *Storage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var err error
+	for _, p := range s.days {
+		if e := p.file.Close(); e != nil {
+			err = e
+		}
+	}
+	s.days = nil
+	return err
+}
+
+// Write implements cntdb.Storage.
+func (s *Storage) Write(batch *cntdb.Batch) error {
+	now := time.Now()
+
+	var flags byte
+	if batch.Incr {
+		flags |= flagIncr
+	}
+
+	// group records by day
+	records := make(map[int64][]record)
+	for _, ent := range batch.Entries {
+		day, ok := parseKeyDay(ent.Key)
+		if !ok {
+			return errInvalidKey
+		}
+		records[day] = append(records[day], record{
+			flags:   flags,
+			expires: now.Add(ent.TTL).Unix(),
+			key:     ent.Key,
+			minute:  ent.Minute,
+			value:   ent.Value,
+			index:   ent.Index,
+		})
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.append(records)
+}
+
+// Remove implements cntdb.Storage.
+func (s *Storage) Remove(_ context.Context, removals []cntdb.Removal) error {
+	records := make(map[int64][]record)
+	for _, rem := range removals {
+		day, ok := parseKeyDay(rem.Key)
+		if !ok {
+			return errInvalidKey
+		}
+		if len(rem.Minutes) == 0 {
+			records[day] = append(records[day], record{flags: flagDrop, key: rem.Key, index: rem.Index})
+			continue
+		}
+		for _, minute := range rem.Minutes {
+			records[day] = append(records[day], record{flags: flagRemove, key: rem.Key, minute: minute, index: rem.Index})
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// nothing to remove from missing partitions
+	for day := range records {
+		if _, ok := s.days[day]; !ok {
+			delete(records, day)
+		}
+	}
+	return s.append(records)
+}
+
+// ReadMeta implements cntdb.Storage.
+func (s *Storage) ReadMeta(_ context.Context, name string) (map[string]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.readMeta(name)
+}
+
+// WriteMeta implements cntdb.Storage. Meta records are stored as JSON files,
+// which are replaced atomically.
+func (s *Storage) WriteMeta(name, field, value string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fields, err := s.readMeta(name)
+	if err != nil {
+		return err
+	}
+	if value == "" {
+		delete(fields, field)
+	} else {
+		fields[field] = value
+	}
+
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+
+	fname := filepath.Join(s.dir, name+".meta")
+	if err := ioutil.WriteFile(fname+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(fname+".tmp", fname)
+}
+
+// ScanIndex implements cntdb.Storage. Only partitions between minDay and
+// maxDay are scanned.
+func (s *Storage) ScanIndex(ctx context.Context, index string, minDay, maxDay int64, fn func(string) error) error {
+	s.mu.RLock()
+	var members []string
+	for day, p := range s.days {
+		if day < minDay || day > maxDay {
+			continue
+		}
+		for member := range p.index[index] {
+			members = append(members, member)
+		}
+	}
+	s.mu.RUnlock()
+
+	for _, member := range members {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		if err := fn(member); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadSeries implements cntdb.Storage.
+func (s *Storage) ReadSeries(ctx context.Context, ranges []cntdb.SeriesRange, fn func(string, int, int64) error) error {
+	type value struct {
+		key    string
+		minute int
+		value  int64
+	}
+
+	now := time.Now().Unix()
+	values := make([]value, 0, len(ranges))
+
+	s.mu.RLock()
+	for _, r := range ranges {
+		day, ok := parseKeyDay(r.Key)
+		if !ok {
+			continue
+		}
+		p, ok := s.days[day]
+		if !ok {
+			continue
+		}
+		ser, ok := p.series[r.Key]
+		if !ok || ser.expires <= now {
+			continue
+		}
+		for minute, v := range ser.values {
+			if r.Contains(minute) {
+				values = append(values, value{key: r.Key, minute: minute, value: v})
+			}
+		}
+	}
+	s.mu.RUnlock()
+
+	for _, v := range values {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		if err := fn(v.key, v.minute, v.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CompactIndex implements cntdb.Storage. It removes expired keys from
+// in-memory index sets and drops partitions entirely once all their series
+// have expired or have been removed from all indices. All partitions are
+// processed on every call.
+func (s *Storage) CompactIndex(ctx context.Context, expired func(string) (bool, error), _ bool) (*cntdb.CompactStats, error) {
+	now := time.Now().Unix()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats := &cntdb.CompactStats{Wrapped: true}
+	for day, p := range s.days {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		default:
+		}
+
+		for name, set := range p.index {
+			stats.KeysScanned++
+			for member := range set {
+				if ok, err := expired(member); err != nil {
+					return nil, err
+				} else if ok {
+					delete(set, member)
+					stats.MembersRemoved++
+				}
+			}
+			if len(set) == 0 {
+				delete(p.index, name)
+			}
+		}
+
+		if p.expires <= now || len(p.index) == 0 {
+			if err := s.drop(day); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return stats, nil
+}
+
+// append appends records to the logs of their partitions and applies
+// them. Must be called while holding the lock.
+func (s *Storage) append(records map[int64][]record) error {
+	var buf []byte
+	for day, recs := range records {
+		p, err := s.partition(day)
+		if err != nil {
+			return err
+		}
+
+		buf = buf[:0]
+		for i := range recs {
+			buf = recs[i].appendTo(buf)
+		}
+		if p.err != nil {
+			return p.err
+		}
+		if _, err := p.file.Write(buf); err != nil {
+			p.rollback()
+			return err
+		}
+		if s.opt.Sync {
+			if err := p.file.Sync(); err != nil {
+				p.rollback()
+				return err
+			}
+		}
+		p.size += int64(len(buf))
+
+		for i := range recs {
+			p.apply(&recs[i])
+		}
+	}
+	return nil
+}
+
+// readMeta reads a meta record. Must be called while holding the lock.
+func (s *Storage) readMeta(name string) (map[string]string, error) {
+	fields := make(map[string]string)
+	data, err := ioutil.ReadFile(filepath.Join(s.dir, name+".meta"))
+	if os.IsNotExist(err) {
+		return fields, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
+
+// partition returns a partition for the given day, opening the log if
+// necessary. Must be called while holding the lock.
+func (s *Storage) partition(day int64) (*partition, error) {
+	if p, ok := s.days[day]; ok {
+		return p, nil
+	}
+
+	file, err := os.OpenFile(s.fileName(day), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &partition{
+		file:   file,
+		series: make(map[string]*series),
+		index:  make(map[string]map[string]struct{}),
+	}
+
+	// replay log, truncate torn tail
+	rr := newRecordReader(file)
+	for {
+		var rec record
+		if err := rr.Read(&rec); err == io.EOF {
+			break
+		} else if err != nil {
+			if err := file.Truncate(rr.pos); err != nil {
+				_ = file.Close()
+				return nil, err
+			}
+			break
+		}
+		p.apply(&rec)
+	}
+	if _, err := file.Seek(rr.pos, io.SeekStart); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	p.size = rr.pos
+
+	s.days[day] = p
+	return p, nil
+}
+
+// drop removes a partition. Must be called while holding the lock.
+func (s *Storage) drop(day int64) error {
+	p, ok := s.days[day]
+	if !ok {
+		return nil
+	}
+	delete(s.days, day)
+
+	if err := p.file.Close(); err != nil {
+		return err
+	}
+	return os.Remove(s.fileName(day))
+}
+
+func (s *Storage) fileName(day int64) string {
+	return filepath.Join(s.dir, strconv.FormatInt(day, 10)+".log")
+}
+
+func parseFileName(name string) (int64, bool) {
+	if !strings.HasSuffix(name, ".log") {
+		return 0, false
+	}
+	day, err := strconv.ParseInt(strings.TrimSuffix(name, ".log"), 10, 64)
+	return day, err == nil
+}
+
+// parseKeyDay extracts the day from a s:<series>:<unix-day> key.
+func parseKeyDay(key string) (int64, bool) {
+	piv := strings.LastIndex(key, ":")
+	if !strings.HasPrefix(key, "s:") || piv < 3 {
+		return 0, false
+	}
+	day, err := strconv.ParseInt(key[piv+1:], 10, 64)
+	return day, err == nil
+}
+
+type int64Slice []int64
+
+func (p int64Slice) Len() int           { return len(p) }
+func (p int64Slice) Less(i, j int) bool { return p[i] < p[j] }
+func (p int64Slice) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
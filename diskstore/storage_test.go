@@ -0,0 +1,210 @@
+package diskstore
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bsm/cntdb"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Storage", func() {
+	var dir string
+	var store *Storage
+	var subject *cntdb.DB
+
+	query := func(c *cntdb.Criteria) cntdb.ResultSet {
+		res, err := subject.Query(context.Background(), c)
+		Expect(err).NotTo(HaveOccurred())
+		return res
+	}
+
+	reopen := func() {
+		Expect(store.Close()).To(Succeed())
+
+		var err error
+		store, err = Open(dir, nil)
+		Expect(err).NotTo(HaveOccurred())
+		subject = cntdb.New(store)
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "cntdb-diskstore")
+		Expect(err).NotTo(HaveOccurred())
+
+		store, err = Open(dir, &Options{Sync: true})
+		Expect(err).NotTo(HaveOccurred())
+		subject = cntdb.New(store)
+		Expect(subject.SetRetention("", 100*365*24*time.Hour)).To(Succeed())
+
+		Expect(subject.Set([]cntdb.Point{
+			point("cpu,a,b 1414141200 1"),  // 2014-10-24T09:00:00Z
+			point("cpu,a,c 1414141300 2"),  // 2014-10-24T09:01:40Z
+			point("cpu,a,c 1414142000 4"),  // 2014-10-24T09:13:20Z
+			point("cpu,b,c 1414146000 8"),  // 2014-10-24T10:20:00Z
+			point("cpu,a,b 1414200000 16"), // 2014-10-25T01:20:00Z
+			point("mem,a,c 1414141200 64"),
+		})).To(Succeed())
+		Expect(subject.Increment([]cntdb.Point{
+			point("cpu,b,c 1414230000 30"), // 2014-10-25T09:40:00Z
+			point("cpu,b,c 1414230000 2"),  // 2014-10-25T09:40:00Z
+		})).To(Succeed())
+	})
+
+	AfterEach(func() {
+		Expect(store.Close()).To(Succeed())
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	It("should partition by day", func() {
+		Expect(store.Days()).To(Equal([]int64{16367, 16368}))
+		Expect(filepath.Glob(filepath.Join(dir, "*.log"))).To(ConsistOf(
+			filepath.Join(dir, "16367.log"),
+			filepath.Join(dir, "16368.log"),
+		))
+	})
+
+	It("should query", func() {
+		Expect(query(&cntdb.Criteria{Metric: "cpu", From: xmltime("2014-10-24T09:00:00Z"), Interval: time.Hour})).To(Equal(cntdb.ResultSet{
+			{Timestamp: xmltime("2014-10-24T09:00:00Z"), Value: 7, End: xmltime("2014-10-24T10:00:00Z")},
+			{Timestamp: xmltime("2014-10-24T10:00:00Z"), Value: 8, End: xmltime("2014-10-24T11:00:00Z")},
+			{Timestamp: xmltime("2014-10-25T01:00:00Z"), Value: 16, End: xmltime("2014-10-25T02:00:00Z")},
+			{Timestamp: xmltime("2014-10-25T09:00:00Z"), Value: 32, End: xmltime("2014-10-25T10:00:00Z")},
+		}))
+		Expect(query(&cntdb.Criteria{Metric: "cpu", From: xmltime("2014-10-24T09:00:00Z"), Until: xmltime("2014-10-24T11:00:00Z"), Tags: []string{"a"}, Interval: time.Hour})).To(Equal(cntdb.ResultSet{
+			{Timestamp: xmltime("2014-10-24T09:00:00Z"), Value: 7, End: xmltime("2014-10-24T10:00:00Z")},
+		}))
+	})
+
+	It("should scan only relevant days", func() {
+		var keys []string
+		Expect(store.ScanIndex(context.Background(), "m:cpu", 16368, 16368, func(key string) error {
+			keys = append(keys, key)
+			return nil
+		})).To(Succeed())
+		Expect(keys).To(ConsistOf("s:cpu,a,b:16368", "s:cpu,b,c:16368"))
+	})
+
+	It("should persist", func() {
+		reopen()
+		Expect(store.Days()).To(Equal([]int64{16367, 16368}))
+		Expect(query(&cntdb.Criteria{Metric: "cpu", From: xmltime("2014-10-24T09:00:00Z"), Interval: 24 * time.Hour})).To(Equal(cntdb.ResultSet{
+			{Timestamp: xmltime("2014-10-24T00:00:00Z"), Value: 15, End: xmltime("2014-10-25T00:00:00Z")},
+			{Timestamp: xmltime("2014-10-25T00:00:00Z"), Value: 48, End: xmltime("2014-10-26T00:00:00Z")},
+		}))
+	})
+
+	It("should recover from torn writes", func() {
+		name := filepath.Join(dir, "16368.log")
+		data, err := ioutil.ReadFile(name)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ioutil.WriteFile(name, data[:len(data)-3], 0644)).To(Succeed())
+
+		reopen()
+		Expect(query(&cntdb.Criteria{Metric: "cpu", From: xmltime("2014-10-25T00:00:00Z"), Interval: 24 * time.Hour})).To(Equal(cntdb.ResultSet{
+			{Timestamp: xmltime("2014-10-25T00:00:00Z"), Value: 46, End: xmltime("2014-10-26T00:00:00Z")},
+		}))
+
+		info, err := os.Stat(name)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(info.Size()).To(BeNumerically("<", len(data)-3))
+
+		Expect(subject.Increment([]cntdb.Point{point("cpu,b,c 1414230000 2")})).To(Succeed())
+		reopen()
+		Expect(query(&cntdb.Criteria{Metric: "cpu", From: xmltime("2014-10-25T00:00:00Z"), Interval: 24 * time.Hour})).To(Equal(cntdb.ResultSet{
+			{Timestamp: xmltime("2014-10-25T00:00:00Z"), Value: 48, End: xmltime("2014-10-26T00:00:00Z")},
+		}))
+	})
+
+	It("should roll back failed appends", func() {
+		part := store.days[16368]
+		_, err := part.file.Write([]byte("torn"))
+		Expect(err).NotTo(HaveOccurred())
+		part.rollback()
+		Expect(part.err).NotTo(HaveOccurred())
+
+		Expect(subject.Increment([]cntdb.Point{point("cpu,b,c 1414230000 2")})).To(Succeed())
+		reopen()
+		Expect(query(&cntdb.Criteria{Metric: "cpu", From: xmltime("2014-10-25T00:00:00Z"), Interval: 24 * time.Hour})).To(Equal(cntdb.ResultSet{
+			{Timestamp: xmltime("2014-10-25T00:00:00Z"), Value: 50, End: xmltime("2014-10-26T00:00:00Z")},
+		}))
+	})
+
+	It("should refuse writes after failed rollbacks", func() {
+		part := store.days[16368]
+		Expect(part.file.Close()).To(Succeed())
+		ro, err := os.Open(filepath.Join(dir, "16368.log"))
+		Expect(err).NotTo(HaveOccurred())
+		part.file = ro
+
+		Expect(subject.Increment([]cntdb.Point{point("cpu,b,c 1414230000 2")})).NotTo(Succeed())
+		Expect(part.err).To(HaveOccurred())
+		Expect(subject.Increment([]cntdb.Point{point("cpu,b,c 1414230000 2")})).To(MatchError(part.err))
+	})
+
+	It("should drop days", func() {
+		Expect(store.DropDay(16367)).To(Succeed())
+		Expect(store.Days()).To(Equal([]int64{16368}))
+		Expect(filepath.Join(dir, "16367.log")).NotTo(BeAnExistingFile())
+
+		reopen()
+		Expect(query(&cntdb.Criteria{Metric: "cpu", From: xmltime("2014-10-24T09:00:00Z"), Interval: 24 * time.Hour})).To(Equal(cntdb.ResultSet{
+			{Timestamp: xmltime("2014-10-25T00:00:00Z"), Value: 48, End: xmltime("2014-10-26T00:00:00Z")},
+		}))
+	})
+
+	It("should persist deletions", func() {
+		Expect(subject.Delete(context.Background(), &cntdb.Criteria{
+			Metric: "cpu",
+			Tags:   []string{"a"},
+			From:   xmltime("2014-10-24T09:00:00Z"),
+			Until:  xmltime("2014-10-24T09:05:00Z"),
+		})).To(Equal(&cntdb.DeleteStats{Keys: 1, Values: 2}))
+
+		reopen()
+		var keys []string
+		Expect(store.ScanIndex(context.Background(), "t:a", 16367, 16368, func(key string) error {
+			keys = append(keys, key)
+			return nil
+		})).To(Succeed())
+		Expect(keys).To(ConsistOf("s:cpu,a,c:16367", "s:cpu,a,b:16368", "s:mem,a,c:16367"))
+		Expect(query(&cntdb.Criteria{Metric: "cpu", From: xmltime("2014-10-24T09:00:00Z"), Interval: 24 * time.Hour})).To(Equal(cntdb.ResultSet{
+			{Timestamp: xmltime("2014-10-24T00:00:00Z"), Value: 12, End: xmltime("2014-10-25T00:00:00Z")},
+			{Timestamp: xmltime("2014-10-25T00:00:00Z"), Value: 48, End: xmltime("2014-10-26T00:00:00Z")},
+		}))
+	})
+
+	It("should compact", func() {
+		Expect(subject.Set([]cntdb.Point{point("cpu,a,c 1818181818 2")})).To(Succeed())
+		Expect(subject.SetRetention("", 0)).To(Succeed())
+		Expect(subject.Compact(context.Background())).To(Succeed())
+		Expect(store.Days()).To(Equal([]int64{21043}))
+	})
+
+})
+
+// --------------------------------------------------------------------
+
+func point(s string) cntdb.Point {
+	pt, err := cntdb.ParsePoint(s)
+	if err != nil {
+		Fail(err.Error())
+	}
+	return pt
+}
+
+func xmltime(s string) time.Time {
+	t, _ := time.Parse(time.RFC3339, s)
+	return t.Local()
+}
+
+func TestSuite(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "cntdb/diskstore")
+}
@@ -0,0 +1,29 @@
+package cntdb_test
+
+import (
+	"io/ioutil"
+	"os"
+
+	"github.com/bsm/cntdb"
+	"github.com/bsm/cntdb/diskstore"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("DB with disk storage", func() {
+	var dir string
+
+	cntdb.SharedDBExamples(func() cntdb.Storage {
+		var err error
+		dir, err = ioutil.TempDir("", "cntdb-diskstore")
+		Expect(err).NotTo(HaveOccurred())
+
+		store, err := diskstore.Open(dir, nil)
+		Expect(err).NotTo(HaveOccurred())
+		return store
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+})
@@ -0,0 +1,4 @@
+package cntdb
+
+// SharedDBExamples exposes the shared behavioural specs to external tests.
+var SharedDBExamples = sharedDBExamples
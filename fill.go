@@ -0,0 +1,75 @@
+package cntdb
+
+import (
+	"math"
+	"time"
+)
+
+// FillMode determines how empty buckets are filled.
+type FillMode int
+
+const (
+	// FillNone omits empty buckets.
+	FillNone FillMode = iota
+	// FillZero fills empty buckets with zeros.
+	FillZero
+	// FillPrevious fills empty buckets with the value of the previous
+	// bucket. Leading empty buckets are filled with zeros.
+	FillPrevious
+	// FillLinear interpolates empty buckets between the surrounding
+	// buckets, rounded to the nearest integer. Leading and trailing empty
+	// buckets are filled with zeros.
+	FillLinear
+)
+
+// fills empty buckets between from and until, res must be sorted
+func fillBuckets(res ResultSet, mode FillMode, bkt bucketing, from, until time.Time) ResultSet {
+	if mode == FillNone {
+		return res
+	}
+
+	starts := bkt.Starts(from, until)
+	filled := make(ResultSet, 0, len(starts))
+	known := make([]bool, 0, len(starts))
+
+	n := 0
+	for _, ts := range starts {
+		for n < len(res) && res[n].Timestamp.Before(ts) {
+			n++
+		}
+		if n < len(res) && res[n].Timestamp.Equal(ts) {
+			filled = append(filled, res[n])
+			known = append(known, true)
+			continue
+		}
+
+		val := int64(0)
+		if mode == FillPrevious && len(filled) != 0 {
+			val = filled[len(filled)-1].Value
+		}
+		filled = append(filled, Result{ts, val, bkt.Next(ts)})
+		known = append(known, false)
+	}
+
+	if mode == FillLinear {
+		interpolate(filled, known)
+	}
+	return filled
+}
+
+// interpolates unknown values between known ones
+func interpolate(res ResultSet, known []bool) {
+	prev := -1
+	for i := range res {
+		if !known[i] {
+			continue
+		}
+		if prev > -1 && i-prev > 1 {
+			a, z := float64(res[prev].Value), float64(res[i].Value)
+			for j := prev + 1; j < i; j++ {
+				res[j].Value = int64(math.Round(a + (z-a)*float64(j-prev)/float64(i-prev)))
+			}
+		}
+		prev = i
+	}
+}
@@ -0,0 +1,67 @@
+package cntdb
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-redis/redis"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Fill", func() {
+	var subject *DB
+	var client *redis.Client
+
+	t0 := xmltime("2014-10-24T08:00:00Z")
+	at := func(n int) time.Time { return t0.Add(time.Duration(n) * time.Hour) }
+
+	query := func(mode FillMode) ResultSet {
+		res, err := subject.Query(context.Background(), &Criteria{
+			Metric:   "req",
+			From:     at(0).Add(30 * time.Minute),
+			Until:    at(6),
+			Interval: time.Hour,
+			Fill:     mode,
+		})
+		Expect(err).NotTo(HaveOccurred())
+		return res
+	}
+
+	BeforeEach(func() {
+		subject, client = openTestDB("2014-10-25T00:00:00Z")
+
+		Expect(subject.Increment([]Point{
+			point("req,a 1414141200 10"), // 2014-10-24T09:00:00Z
+			point("req,a 1414152000 40"), // 2014-10-24T12:00:00Z
+			point("req,a 1414155600 41"), // 2014-10-24T13:00:00Z
+		})).To(Succeed())
+	})
+
+	AfterEach(func() {
+		closeTestDB(client)
+	})
+
+	It("should not fill by default", func() {
+		Expect(query(FillNone)).To(Equal(ResultSet{{at(1), 10, at(2)}, {at(4), 40, at(5)}, {at(5), 41, at(6)}}))
+	})
+
+	It("should fill with zeros", func() {
+		Expect(query(FillZero)).To(Equal(ResultSet{
+			{at(0), 0, at(1)}, {at(1), 10, at(2)}, {at(2), 0, at(3)}, {at(3), 0, at(4)}, {at(4), 40, at(5)}, {at(5), 41, at(6)}, {at(6), 0, at(7)},
+		}))
+	})
+
+	It("should fill with previous values", func() {
+		Expect(query(FillPrevious)).To(Equal(ResultSet{
+			{at(0), 0, at(1)}, {at(1), 10, at(2)}, {at(2), 10, at(3)}, {at(3), 10, at(4)}, {at(4), 40, at(5)}, {at(5), 41, at(6)}, {at(6), 41, at(7)},
+		}))
+	})
+
+	It("should fill linearly", func() {
+		Expect(query(FillLinear)).To(Equal(ResultSet{
+			{at(0), 0, at(1)}, {at(1), 10, at(2)}, {at(2), 20, at(3)}, {at(3), 30, at(4)}, {at(4), 40, at(5)}, {at(5), 41, at(6)}, {at(6), 0, at(7)},
+		}))
+	})
+
+})
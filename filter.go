@@ -0,0 +1,258 @@
+package cntdb
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/bsm/strset"
+)
+
+var errBadFilter = errors.New("cntdb: bad tag filter")
+
+// TagFilter is a boolean expression over tags. Filters are built using
+// Tag, AllOf, AnyOf and NoneOf or parsed by ParseTagFilter.
+type TagFilter interface {
+	// String returns the filter in the format accepted by ParseTagFilter.
+	String() string
+
+	// eval returns the subset of scope matching the filter, lookup returns
+	// the series keys of a tag.
+	eval(scope *strset.Set, lookup func(tag string) (*strset.Set, error)) (*strset.Set, error)
+
+	// tags returns all tags referenced by the filter.
+	tags() []string
+}
+
+// Tag matches series with the given tag.
+func Tag(name string) TagFilter { return tagFilter(name) }
+
+// AllOf matches series which match all filters.
+func AllOf(filters ...TagFilter) TagFilter { return andFilter(filters) }
+
+// AnyOf matches series which match any of the filters.
+func AnyOf(filters ...TagFilter) TagFilter { return orFilter(filters) }
+
+// NoneOf matches series which match none of the filters.
+func NoneOf(filters ...TagFilter) TagFilter {
+	if len(filters) == 1 {
+		return notFilter{filters[0]}
+	}
+	return notFilter{orFilter(filters)}
+}
+
+type tagFilter string
+
+func (f tagFilter) String() string { return string(f) }
+
+func (f tagFilter) tags() []string { return []string{string(f)} }
+
+func (f tagFilter) eval(scope *strset.Set, lookup func(string) (*strset.Set, error)) (*strset.Set, error) {
+	set, err := lookup(string(f))
+	if err != nil {
+		return nil, err
+	}
+	return scope.Intersect(set), nil
+}
+
+type andFilter []TagFilter
+
+func (f andFilter) String() string { return joinFilters(f, " AND ") }
+
+func (f andFilter) tags() []string { return joinTags(f) }
+
+func (f andFilter) eval(scope *strset.Set, lookup func(string) (*strset.Set, error)) (*strset.Set, error) {
+	for _, sub := range f {
+		var err error
+		if scope, err = sub.eval(scope, lookup); err != nil {
+			return nil, err
+		}
+	}
+	return scope, nil
+}
+
+type orFilter []TagFilter
+
+func (f orFilter) String() string { return joinFilters(f, " OR ") }
+
+func (f orFilter) tags() []string { return joinTags(f) }
+
+func (f orFilter) eval(scope *strset.Set, lookup func(string) (*strset.Set, error)) (*strset.Set, error) {
+	matches := strset.New(10)
+	for _, sub := range f {
+		set, err := sub.eval(scope, lookup)
+		if err != nil {
+			return nil, err
+		}
+		matches = matches.Union(set)
+	}
+	return matches, nil
+}
+
+type notFilter struct{ TagFilter }
+
+func (f notFilter) String() string { return "NOT " + f.TagFilter.String() }
+
+func (f notFilter) eval(scope *strset.Set, lookup func(string) (*strset.Set, error)) (*strset.Set, error) {
+	set, err := f.TagFilter.eval(scope, lookup)
+	if err != nil {
+		return nil, err
+	}
+
+	excluded := make(map[string]struct{}, len(set.Slice()))
+	for _, key := range set.Slice() {
+		excluded[key] = struct{}{}
+	}
+
+	matches := strset.New(10)
+	for _, key := range scope.Slice() {
+		if _, ok := excluded[key]; !ok {
+			matches.Add(key)
+		}
+	}
+	return matches, nil
+}
+
+func joinTags(filters []TagFilter) []string {
+	var tags []string
+	for _, sub := range filters {
+		tags = append(tags, sub.tags()...)
+	}
+	return tags
+}
+
+func joinFilters(filters []TagFilter, sep string) string {
+	if len(filters) == 1 {
+		return filters[0].String()
+	}
+
+	parts := make([]string, len(filters))
+	for i, sub := range filters {
+		parts[i] = sub.String()
+	}
+	return "(" + strings.Join(parts, sep) + ")"
+}
+
+// --------------------------------------------------------------------
+
+// ParseTagFilter parses a tag filter expression, e.g.
+//
+//	(region:eu AND status:500) OR NOT internal
+//
+// The operators AND, OR and NOT must be upper-case. AND binds tighter than
+// OR, parentheses may be used for grouping.
+func ParseTagFilter(s string) (TagFilter, error) {
+	p := &filterParser{tokens: tokenizeFilter(s)}
+	filter, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos != len(p.tokens) {
+		return nil, errBadFilter
+	}
+	return filter, nil
+}
+
+type filterParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *filterParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *filterParser) next() string {
+	tok := p.peek()
+	p.pos++
+	return tok
+}
+
+func (p *filterParser) parseOr() (TagFilter, error) {
+	var filters orFilter
+	for {
+		sub, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, sub)
+
+		if p.peek() != "OR" {
+			break
+		}
+		p.next()
+	}
+
+	if len(filters) == 1 {
+		return filters[0], nil
+	}
+	return filters, nil
+}
+
+func (p *filterParser) parseAnd() (TagFilter, error) {
+	var filters andFilter
+	for {
+		sub, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, sub)
+
+		if p.peek() != "AND" {
+			break
+		}
+		p.next()
+	}
+
+	if len(filters) == 1 {
+		return filters[0], nil
+	}
+	return filters, nil
+}
+
+func (p *filterParser) parseNot() (TagFilter, error) {
+	switch tok := p.next(); tok {
+	case "NOT":
+		sub, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return notFilter{sub}, nil
+	case "(":
+		sub, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, errBadFilter
+		}
+		return sub, nil
+	default:
+		if tok == "AND" || tok == "OR" || !validTag(tok) {
+			return nil, errBadFilter
+		}
+		return tagFilter(tok), nil
+	}
+}
+
+// splits a filter expression into tags, operators and parentheses
+func tokenizeFilter(s string) []string {
+	var tokens []string
+	for _, field := range strings.Fields(s) {
+		for len(field) != 0 {
+			if i := strings.IndexAny(field, "()"); i > 0 {
+				tokens = append(tokens, field[:i])
+				field = field[i:]
+			} else if i == 0 {
+				tokens = append(tokens, field[:1])
+				field = field[1:]
+			} else {
+				tokens = append(tokens, field)
+				field = ""
+			}
+		}
+	}
+	return tokens
+}
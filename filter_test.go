@@ -0,0 +1,64 @@
+package cntdb
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("TagFilter", func() {
+
+	It("should parse", func() {
+		tests := []struct {
+			s string
+			f TagFilter
+		}{
+			{"a", Tag("a")},
+			{"a AND b", AllOf(Tag("a"), Tag("b"))},
+			{"a OR b AND c", AnyOf(Tag("a"), AllOf(Tag("b"), Tag("c")))},
+			{"(a OR b) AND c", AllOf(AnyOf(Tag("a"), Tag("b")), Tag("c"))},
+			{"(region:eu AND status:500) OR NOT c", AnyOf(AllOf(Tag("region:eu"), Tag("status:500")), NoneOf(Tag("c")))},
+			{"NOT (a OR b)", NoneOf(AnyOf(Tag("a"), Tag("b")))},
+			{"NOT NOT a", NoneOf(NoneOf(Tag("a")))},
+			{" ( a ) ", Tag("a")},
+		}
+
+		for _, test := range tests {
+			f, err := ParseTagFilter(test.s)
+			Expect(err).NotTo(HaveOccurred(), "for %s", test.s)
+			Expect(f).To(Equal(test.f), "for %s", test.s)
+		}
+	})
+
+	It("should fail to parse bad filters", func() {
+		tests := []string{
+			"",
+			"a AND",
+			"OR a",
+			"a b",
+			"(a OR b",
+			"a OR b)",
+			"NOT",
+			"a AND bad!",
+		}
+
+		for _, test := range tests {
+			_, err := ParseTagFilter(test)
+			Expect(err).To(Equal(errBadFilter), "for %s", test)
+		}
+	})
+
+	It("should format", func() {
+		f := AnyOf(AllOf(Tag("a"), Tag("b")), NoneOf(Tag("c")))
+		Expect(f.String()).To(Equal("((a AND b) OR NOT c)"))
+
+		parsed, err := ParseTagFilter(f.String())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(parsed).To(Equal(f))
+	})
+
+	It("should list tags", func() {
+		f := AnyOf(AllOf(Tag("a"), Tag("b")), NoneOf(Tag("c"), Tag("a")))
+		Expect(f.tags()).To(Equal([]string{"a", "b", "c", "a"}))
+	})
+
+})
@@ -0,0 +1,13 @@
+package cntdb_test
+
+import (
+	"github.com/bsm/cntdb"
+	"github.com/bsm/cntdb/cntdbtest"
+	. "github.com/onsi/ginkgo"
+)
+
+var _ = Describe("DB with in-memory storage", func() {
+	cntdb.SharedDBExamples(func() cntdb.Storage {
+		return cntdbtest.NewStorage()
+	})
+})
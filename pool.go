@@ -0,0 +1,72 @@
+package cntdb
+
+import (
+	"context"
+	"sync"
+)
+
+// default number of chunks processed concurrently per query
+const defaultQueryConcurrency = 4
+
+// runChunks calls fn for chunks 0..n-1 on up to workers goroutines. Each
+// chunk is passed its own context, which is cancelled when the chunk
+// returns or when any chunk fails. It returns the first error.
+func runChunks(ctx context.Context, n, workers int, fn func(ctx context.Context, chunk int) error) error {
+	if workers > n {
+		workers = n
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
+	group, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var once sync.Once
+	var first error
+	fail := func(err error) {
+		once.Do(func() {
+			first = err
+			cancel()
+		})
+	}
+
+	chunks := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for chunk := range chunks {
+				if group.Err() != nil {
+					continue
+				}
+
+				cctx, done := context.WithCancel(group)
+				err := fn(cctx, chunk)
+				done()
+
+				if err != nil {
+					fail(err)
+				}
+			}
+		}()
+	}
+
+feed:
+	for chunk := 0; chunk < n; chunk++ {
+		select {
+		case chunks <- chunk:
+		case <-group.Done():
+			break feed
+		}
+	}
+	close(chunks)
+	wg.Wait()
+
+	if first != nil {
+		return first
+	}
+	return ctx.Err()
+}
@@ -0,0 +1,70 @@
+package cntdb
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("runChunks", func() {
+
+	It("should run all chunks on bounded workers", func() {
+		var mu sync.Mutex
+		var running, peak int
+		seen := make(map[int]bool)
+
+		Expect(runChunks(context.Background(), 20, 3, func(_ context.Context, chunk int) error {
+			mu.Lock()
+			running++
+			if running > peak {
+				peak = running
+			}
+			seen[chunk] = true
+			mu.Unlock()
+
+			defer func() {
+				mu.Lock()
+				running--
+				mu.Unlock()
+			}()
+			return nil
+		})).To(Succeed())
+		Expect(seen).To(HaveLen(20))
+		Expect(peak).To(BeNumerically("<=", 3))
+	})
+
+	It("should cancel remaining chunks on failure", func() {
+		failed := errors.New("failed")
+		err := runChunks(context.Background(), 100, 2, func(ctx context.Context, chunk int) error {
+			if chunk == 0 {
+				return failed
+			}
+			<-ctx.Done()
+			return ctx.Err()
+		})
+		Expect(err).To(Equal(failed))
+	})
+
+	It("should stop on cancelled contexts", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		calls := 0
+		err := runChunks(ctx, 10, 1, func(ctx context.Context, _ int) error {
+			calls++
+			return ctx.Err()
+		})
+		Expect(err).To(Equal(context.Canceled))
+		Expect(calls).To(BeZero())
+	})
+
+	It("should run without chunks", func() {
+		Expect(runChunks(context.Background(), 0, 4, func(context.Context, int) error {
+			return errors.New("unexpected")
+		})).To(Succeed())
+	})
+
+})
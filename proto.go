@@ -63,14 +63,9 @@ func NewPointAt(metric string, tags []string, at time.Time, count int64) (Point,
 	}
 
 	for _, tag := range tags {
-		if len(tag) < 1 || len(tag) > 50 {
+		if !validTag(tag) {
 			return Point{}, errInvalidTag
 		}
-		for _, c := range tag {
-			if (c < '0' || c > '9') && (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && c != ':' && c != '-' && c != '_' {
-				return Point{}, errInvalidTag
-			}
-		}
 	}
 
 	sort.Strings(tags)
@@ -96,3 +91,15 @@ func (p Point) keyName() string {
 func (p Point) memberName() string {
 	return fmt.Sprintf("%04d", p.timestamp.MinuteOfDay())
 }
+
+func validTag(tag string) bool {
+	if len(tag) < 1 || len(tag) > 50 {
+		return false
+	}
+	for _, c := range tag {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && c != ':' && c != '-' && c != '_' {
+			return false
+		}
+	}
+	return true
+}
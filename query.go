@@ -0,0 +1,405 @@
+package cntdb
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// SyntaxError is returned by ParseQuery for malformed queries.
+type SyntaxError struct {
+	Pos int    // byte offset in the query
+	Msg string // description of the problem
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("cntdb: syntax error at position %d: %s", e.Pos, e.Msg)
+}
+
+// ParseQuery parses a text query into criteria, e.g.
+//
+//	sum(checkout{region:eu,!test}) by 1h from -7d until now fill zero
+//
+// A query consists of a metric, optionally followed by a tag filter in
+// braces, and may be wrapped in an aggregation (sum, count, min, max, mean
+// or a percentile such as p95). Tag filters combine tags with ',' or AND,
+// '|' or OR and '!' or NOT, parentheses may be used for grouping.
+//
+// The following clauses may follow in any order:
+//
+//	by <interval>           bucket interval, e.g. 15m, 1h, 7d, or a calendar
+//	                        interval: day, week, week-sunday, month, quarter
+//	                        or year
+//	from <time>             start of the range
+//	until <time>            end of the range
+//	fill <mode>             none, zero, previous or linear
+//	group by <prefix>, ...  tag prefixes to group by
+//	offset <duration>       bucket offset
+//	tz <location>           time zone, e.g. Europe/Berlin
+//
+// Times may be given as now, relative to now (-7d, now-1h), as RFC3339 or
+// as Unix seconds. Relative times are stored as FromAgo and UntilAgo, now
+// as Now, and resolved whenever the criteria are queried.
+func ParseQuery(s string) (*Criteria, error) {
+	p := &queryParser{tokens: lexQuery(s)}
+	return p.parse()
+}
+
+// --------------------------------------------------------------------
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenPunct
+	tokenInvalid
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokenEOF:
+		return "end of query"
+	case tokenInvalid:
+		return fmt.Sprintf("invalid character %q", t.text)
+	}
+	return fmt.Sprintf("%q", t.text)
+}
+
+// splits a query into tokens, the last token is always tokenEOF
+func lexQuery(s string) []token {
+	var tokens []token
+	for pos := 0; pos < len(s); {
+		c := rune(s[pos])
+		switch {
+		case unicode.IsSpace(c):
+			pos++
+		case strings.ContainsRune("(){},!|", c):
+			tokens = append(tokens, token{kind: tokenPunct, text: s[pos : pos+1], pos: pos})
+			pos++
+		case isIdentChar(c):
+			end := pos + 1
+			for end < len(s) && isIdentChar(rune(s[end])) {
+				end++
+			}
+			tokens = append(tokens, token{kind: tokenIdent, text: s[pos:end], pos: pos})
+			pos = end
+		default:
+			tokens = append(tokens, token{kind: tokenInvalid, text: s[pos : pos+1], pos: pos})
+			pos++
+		}
+	}
+	return append(tokens, token{kind: tokenEOF, pos: len(s)})
+}
+
+func isIdentChar(c rune) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || strings.ContainsRune(":-_.@/+", c)
+}
+
+// --------------------------------------------------------------------
+
+type queryParser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *queryParser) peek() token { return p.tokens[p.pos] }
+
+func (p *queryParser) next() token {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokenEOF {
+		p.pos++
+	}
+	return tok
+}
+
+// is returns true if the next token is the given punctuation or keyword
+func (p *queryParser) is(text string) bool {
+	tok := p.peek()
+	return (tok.kind == tokenPunct || tok.kind == tokenIdent) && tok.text == text
+}
+
+func (p *queryParser) expect(text string) error {
+	if tok := p.next(); tok.text != text || tok.kind == tokenEOF {
+		return p.errorf(tok, "expected %q, found %s", text, tok)
+	}
+	return nil
+}
+
+func (p *queryParser) ident(what string) (token, error) {
+	tok := p.next()
+	if tok.kind != tokenIdent {
+		return tok, p.errorf(tok, "expected %s, found %s", what, tok)
+	}
+	return tok, nil
+}
+
+func (p *queryParser) errorf(tok token, format string, args ...interface{}) error {
+	return &SyntaxError{Pos: tok.pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (p *queryParser) parse() (*Criteria, error) {
+	crit := new(Criteria)
+
+	wrapped := false
+	if p.peek().kind == tokenIdent && p.tokens[p.pos+1].text == "(" {
+		tok := p.next()
+		if crit.Aggregate = Aggregation(tok.text); !crit.Aggregate.Valid() {
+			return nil, p.errorf(tok, "unknown aggregation %s", tok)
+		}
+		p.next()
+		wrapped = true
+	}
+
+	tok, err := p.ident("metric")
+	if err != nil {
+		return nil, err
+	}
+	crit.Metric = tok.text
+
+	if p.is("{") {
+		p.next()
+		if crit.Filter, err = p.parseOr(); err != nil {
+			return nil, err
+		}
+		if err := p.expect("}"); err != nil {
+			return nil, err
+		}
+	}
+
+	if wrapped {
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+	}
+
+	for p.peek().kind != tokenEOF {
+		if err := p.parseClause(crit); err != nil {
+			return nil, err
+		}
+	}
+	return crit, nil
+}
+
+func (p *queryParser) parseClause(crit *Criteria) error {
+	kw, err := p.ident("clause")
+	if err != nil {
+		return err
+	}
+
+	if kw.text == "group" {
+		if err := p.expect("by"); err != nil {
+			return err
+		}
+		for {
+			tok, err := p.ident("tag prefix")
+			if err != nil {
+				return err
+			}
+			crit.GroupBy = append(crit.GroupBy, tok.text)
+			if !p.is(",") {
+				return nil
+			}
+			p.next()
+		}
+	}
+
+	tok, err := p.ident("value")
+	if err != nil {
+		return err
+	}
+
+	switch kw.text {
+	case "by":
+		if cal, ok := calendarNames[tok.text]; ok {
+			crit.Calendar = cal
+		} else if crit.Interval, err = parseQueryDuration(tok.text); err != nil || crit.Interval < time.Minute {
+			return p.errorf(tok, "invalid interval %s", tok)
+		}
+	case "from", "until":
+		ts, ago, err := p.parseTime(tok)
+		if err != nil {
+			return err
+		}
+		if kw.text == "from" {
+			crit.From, crit.FromAgo = ts, ago
+		} else {
+			crit.Until, crit.UntilAgo = ts, ago
+		}
+	case "fill":
+		mode, ok := fillNames[tok.text]
+		if !ok {
+			return p.errorf(tok, "unknown fill mode %s", tok)
+		}
+		crit.Fill = mode
+	case "offset":
+		if crit.Offset, err = parseQueryDuration(tok.text); err != nil {
+			return p.errorf(tok, "invalid offset %s", tok)
+		}
+	case "tz":
+		if crit.Location, err = time.LoadLocation(tok.text); err != nil {
+			return p.errorf(tok, "unknown time zone %s", tok)
+		}
+	default:
+		return p.errorf(kw, "unknown clause %s", kw)
+	}
+	return nil
+}
+
+// parses now, relative, RFC3339 and unix times; relative times are
+// returned as a duration before now, now is returned as Now
+func (p *queryParser) parseTime(tok token) (time.Time, time.Duration, error) {
+	s := tok.text
+	if s == "now" {
+		return time.Time{}, Now, nil
+	}
+	if strings.HasPrefix(s, "now-") {
+		s = s[3:]
+	}
+	if strings.HasPrefix(s, "-") {
+		if d, err := parseQueryDuration(s[1:]); err == nil {
+			return time.Time{}, d, nil
+		}
+	} else if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, 0, nil
+	} else if sec, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(sec, 0), 0, nil
+	}
+	return time.Time{}, 0, p.errorf(tok, "invalid time %s", tok)
+}
+
+func (p *queryParser) parseOr() (TagFilter, error) {
+	var filters orFilter
+	for {
+		sub, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, sub)
+
+		if !p.is("|") && !p.is("OR") {
+			break
+		}
+		p.next()
+	}
+
+	if len(filters) == 1 {
+		return filters[0], nil
+	}
+	return filters, nil
+}
+
+func (p *queryParser) parseAnd() (TagFilter, error) {
+	var filters andFilter
+	for {
+		sub, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, sub)
+
+		if !p.is(",") && !p.is("AND") {
+			break
+		}
+		p.next()
+	}
+
+	if len(filters) == 1 {
+		return filters[0], nil
+	}
+	return filters, nil
+}
+
+func (p *queryParser) parseNot() (TagFilter, error) {
+	switch {
+	case p.is("!"), p.is("NOT"):
+		p.next()
+		sub, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return notFilter{sub}, nil
+	case p.is("("):
+		p.next()
+		sub, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return sub, nil
+	}
+
+	tok, err := p.ident("tag")
+	if err != nil {
+		return nil, err
+	} else if tok.text == "AND" || tok.text == "OR" || !validTag(tok.text) {
+		return nil, p.errorf(tok, "invalid tag %s", tok)
+	}
+	return tagFilter(tok.text), nil
+}
+
+// --------------------------------------------------------------------
+
+var calendarNames = map[string]Calendar{
+	"day":         CalendarDay,
+	"week":        CalendarWeek,
+	"week-sunday": CalendarWeekSunday,
+	"month":       CalendarMonth,
+	"quarter":     CalendarQuarter,
+	"year":        CalendarYear,
+}
+
+var fillNames = map[string]FillMode{
+	"none":     FillNone,
+	"zero":     FillZero,
+	"previous": FillPrevious,
+	"linear":   FillLinear,
+}
+
+var durationUnits = map[byte]time.Duration{
+	's': time.Second,
+	'm': time.Minute,
+	'h': time.Hour,
+	'd': 24 * time.Hour,
+	'w': 7 * 24 * time.Hour,
+}
+
+// parses durations such as 90m, 1h30m or 7d
+func parseQueryDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, errBadFormat
+	}
+
+	var d time.Duration
+	for s != "" {
+		n := 0
+		for n < len(s) && s[n] >= '0' && s[n] <= '9' {
+			n++
+		}
+		if n == 0 || n == len(s) {
+			return 0, errBadFormat
+		}
+
+		unit, ok := durationUnits[s[n]]
+		if !ok {
+			return 0, errBadFormat
+		}
+		num, err := strconv.ParseInt(s[:n], 10, 64)
+		if err != nil {
+			return 0, errBadFormat
+		}
+		d += time.Duration(num) * unit
+		s = s[n+1:]
+	}
+	return d, nil
+}
@@ -0,0 +1,125 @@
+package cntdb
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ParseQuery", func() {
+	It("should parse", func() {
+		berlin, err := time.LoadLocation("Europe/Berlin")
+		Expect(err).NotTo(HaveOccurred())
+
+		tests := []struct {
+			s string
+			c *Criteria
+		}{
+			{"cpu", &Criteria{Metric: "cpu"}},
+			{"sum(checkout{region:eu,!test}) by 1h from -7d until now fill zero", &Criteria{
+				Metric:    "checkout",
+				Filter:    AllOf(Tag("region:eu"), NoneOf(Tag("test"))),
+				Aggregate: AggSum,
+				Interval:  time.Hour,
+				FromAgo:   7 * 24 * time.Hour,
+				UntilAgo:  Now,
+				Fill:      FillZero,
+			}},
+			{"p95(latency{(a | b), NOT c})", &Criteria{
+				Metric:    "latency",
+				Filter:    AllOf(AnyOf(Tag("a"), Tag("b")), NoneOf(Tag("c"))),
+				Aggregate: AggPercentile(95),
+			}},
+			{"cpu.1h{a OR b AND c}", &Criteria{
+				Metric: "cpu.1h",
+				Filter: AnyOf(Tag("a"), AllOf(Tag("b"), Tag("c"))),
+			}},
+			{"mean(cpu) by 1h30m from now-2h until 1414231200 group by host:, dc:", &Criteria{
+				Metric:    "cpu",
+				Aggregate: AggMean,
+				Interval:  90 * time.Minute,
+				FromAgo:   2 * time.Hour,
+				Until:     xmltime("2014-10-25T10:00:00Z"),
+				GroupBy:   []string{"host:", "dc:"},
+			}},
+			{"cpu by week-sunday tz Europe/Berlin offset 6h from 2014-10-01T00:00:00Z fill previous", &Criteria{
+				Metric:   "cpu",
+				Calendar: CalendarWeekSunday,
+				Location: berlin,
+				Offset:   6 * time.Hour,
+				From:     time.Date(2014, 10, 1, 0, 0, 0, 0, time.UTC),
+				Fill:     FillPrevious,
+			}},
+		}
+
+		for _, test := range tests {
+			c, err := ParseQuery(test.s)
+			Expect(err).NotTo(HaveOccurred(), "for %s", test.s)
+			Expect(c).To(Equal(test.c), "for %s", test.s)
+		}
+	})
+
+	It("should report positioned errors", func() {
+		tests := []struct {
+			s   string
+			pos int
+			msg string
+		}{
+			{"", 0, `expected metric, found end of query`},
+			{"avg(cpu)", 0, `unknown aggregation "avg"`},
+			{"sum(cpu", 7, `expected ")", found end of query`},
+			{"cpu{a,}", 6, `expected tag, found "}"`},
+			{"cpu{a b}", 6, `expected "}", found "b"`},
+			{"cpu{a} by 1x", 10, `invalid interval "1x"`},
+			{"cpu by 30s", 7, `invalid interval "30s"`},
+			{"cpu from yesterday", 9, `invalid time "yesterday"`},
+			{"cpu fill nothing", 9, `unknown fill mode "nothing"`},
+			{"cpu group host:", 10, `expected "by", found "host:"`},
+			{"cpu tz Mars/Olympus", 7, `unknown time zone "Mars/Olympus"`},
+			{"cpu limit 10", 4, `unknown clause "limit"`},
+			{"cpu from", 8, `expected value, found end of query`},
+			{"cpu; drop", 3, `expected clause, found invalid character ";"`},
+		}
+
+		for _, test := range tests {
+			_, err := ParseQuery(test.s)
+			Expect(err).To(Equal(&SyntaxError{Pos: test.pos, Msg: test.msg}), "for %s", test.s)
+		}
+
+		_, err := ParseQuery("cpu fill nothing")
+		Expect(err).To(MatchError(`cntdb: syntax error at position 9: unknown fill mode "nothing"`))
+	})
+
+	It("should resolve relative times when queried", func() {
+		c, err := ParseQuery("cpu from -7d until now-1h")
+		Expect(err).NotTo(HaveOccurred())
+
+		now := time.Now()
+		Expect(c.getFrom().Time).To(BeTemporally("~", now.Add(-7*24*time.Hour), time.Second))
+		Expect(c.getUntil().Time).To(BeTemporally("~", now.Add(-time.Hour), time.Second))
+
+		c, err = ParseQuery("cpu from now")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(c.FromAgo).To(Equal(Now))
+		Expect(c.getFrom().Time).To(BeTemporally("~", now, time.Second))
+		Expect(c.getUntil().Time).To(BeTemporally("~", now, time.Second))
+
+		c, err = ParseQuery("cpu from now until now")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(c.getFrom().Time).To(BeTemporally("~", now, time.Second))
+		Expect(c.getUntil().Time).To(BeTemporally("~", now, time.Second))
+	})
+
+	It("should parse durations", func() {
+		Expect(parseQueryDuration("90m")).To(Equal(90 * time.Minute))
+		Expect(parseQueryDuration("1h30m")).To(Equal(90 * time.Minute))
+		Expect(parseQueryDuration("2w1d")).To(Equal(15 * 24 * time.Hour))
+
+		for _, s := range []string{"", "1", "h", "1h2", "1y"} {
+			_, err := parseQueryDuration(s)
+			Expect(err).To(HaveOccurred(), "for %s", s)
+		}
+	})
+
+})
@@ -0,0 +1,1139 @@
+package cntdb
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// migrateScript converts a legacy sorted-set series key into a hash,
+// preserving its TTL.
+var migrateScript = redis.NewScript(`
+if redis.call('TYPE', KEYS[1]).ok ~= 'zset' then return 0 end
+local ttl = redis.call('PTTL', KEYS[1])
+local vals = redis.call('ZRANGE', KEYS[1], 0, -1, 'WITHSCORES')
+redis.call('DEL', KEYS[1])
+for i = 1, #vals, 2 do
+	redis.call('HSET', KEYS[1], vals[i], string.format('%d', tonumber(vals[i+1])))
+end
+if ttl > 0 then redis.call('PEXPIRE', KEYS[1], ttl) end
+return 1
+`)
+
+// extendScript sets the TTL of a key to ARGV[1] milliseconds, unless it
+// already expires later. Day index sets are shared by series of different
+// retention.
+var extendScript = redis.NewScript(`
+if redis.call('PTTL', KEYS[1]) < tonumber(ARGV[1]) then
+	redis.call('PEXPIRE', KEYS[1], ARGV[1])
+end
+return 0
+`)
+
+// pruneScript removes the day ARGV[1] from the day list KEYS[2] once the
+// day index set KEYS[1] is empty.
+var pruneScript = redis.NewScript(`
+if redis.call('SCARD', KEYS[1]) == 0 then
+	redis.call('ZREM', KEYS[2], ARGV[1])
+end
+return 0
+`)
+
+// sumScript sums the values of a series key within a minute range
+// (ARGV[1]..ARGV[2]) into buckets of ARGV[3] minutes, starting at ARGV[4]
+// minutes into the day. It returns pairs of bucket minutes, clamped to the
+// range, and sums. Lua numbers are doubles, so it fails rather than return
+// values beyond 2^53 inexactly.
+var sumScript = redis.NewScript(`
+local min, max = tonumber(ARGV[1]), tonumber(ARGV[2])
+local step, phase = tonumber(ARGV[3]), tonumber(ARGV[4])
+local vals = {}
+local kind = redis.call('TYPE', KEYS[1]).ok
+if kind == 'hash' and max - min + 1 < 720 then
+	local fields = {}
+	for minute = min, max do fields[#fields+1] = string.format('%04d', minute) end
+	local got = redis.call('HMGET', KEYS[1], unpack(fields))
+	for i = 1, #fields do
+		if got[i] then
+			vals[#vals+1] = fields[i]
+			vals[#vals+1] = got[i]
+		end
+	end
+elseif kind == 'hash' then
+	vals = redis.call('HGETALL', KEYS[1])
+elseif kind == 'zset' then
+	vals = redis.call('ZRANGE', KEYS[1], 0, -1, 'WITHSCORES')
+end
+local sums, order = {}, {}
+for i = 1, #vals, 2 do
+	local minute, value = tonumber(vals[i]), tonumber(vals[i+1])
+	if minute >= min and minute <= max then
+		local bucket = math.max(math.floor((minute - phase) / step) * step + phase, min)
+		if not sums[bucket] then
+			sums[bucket] = 0
+			order[#order+1] = bucket
+		end
+		sums[bucket] = sums[bucket] + value
+		if math.abs(value) >= 2^53 or math.abs(sums[bucket]) >= 2^53 then
+			return redis.error_reply('cntdb: inexact sum')
+		end
+	end
+end
+local res = {}
+for _, bucket in ipairs(order) do
+	res[#res+1] = bucket
+	res[#res+1] = sums[bucket]
+end
+return res
+`)
+
+// RedisStorage stores series as hashes of minute-of-day fields with exact
+// integer values and indices as sets per day in Redis, e.g. md:<metric>:<day>
+// for m:<metric>. Series stored as sorted sets by earlier versions are still
+// readable and are converted into hashes when written to, or via
+// MigrateSeries. Index sets of earlier versions spanning all days are still
+// read until converted via MigrateIndex.
+type RedisStorage struct {
+	client  redis.UniversalClient
+	cluster bool // use hash-tagged keys
+	owned   bool // close client on Close
+
+	cursor  uint64            // compaction cursor
+	cursors map[string]uint64 // compaction cursors, by cluster node
+	wrapped map[string]bool   // cluster nodes which completed the current cycle
+	nodes   []string          // master node addresses, by cluster slot
+	loaded  time.Time         // when nodes were loaded
+	mu      sync.Mutex
+}
+
+// NewRedisStorage wraps a redis client. The client is not closed when the
+// storage is closed.
+func NewRedisStorage(client *redis.Client) *RedisStorage {
+	return &RedisStorage{client: client}
+}
+
+// NewRedisClusterStorage wraps a client which may be connected to a Redis
+// Cluster. Keys are hash-tagged by metric (series keys and metric index
+// sets) and tag (tag index sets), so that all series of a metric are
+// co-located with the metric index on the same slot.
+func NewRedisClusterStorage(client redis.UniversalClient) *RedisStorage {
+	return &RedisStorage{client: client, cluster: true, cursors: make(map[string]uint64), wrapped: make(map[string]bool)}
+}
+
+// Close implements Storage. It closes the underlying client, if the
+// client was created by the storage.
+func (s *RedisStorage) Close() error {
+	if s.owned {
+		return s.client.Close()
+	}
+	return nil
+}
+
+// Write implements Storage. Entries without a positive TTL are written
+// without expiry.
+func (s *RedisStorage) Write(batch *Batch) error {
+	failed, err := s.write(batch)
+	if err != nil || len(failed) == 0 {
+		return err
+	}
+
+	// convert legacy keys and retry failed entries
+	for _, ent := range failed {
+		if err := s.migrate(ent.Key); err != nil {
+			return err
+		}
+	}
+	failed, err = s.write(&Batch{Incr: batch.Incr, Entries: failed})
+	if err == nil && len(failed) != 0 {
+		err = fmt.Errorf("cntdb: unable to convert series %s", failed[0].Key)
+	}
+	return err
+}
+
+// MigrateSeries converts all series stored as sorted sets by earlier
+// versions into hashes. It returns the number of converted keys.
+func (s *RedisStorage) MigrateSeries(ctx context.Context) (int, error) {
+	var keys []string
+	if err := s.scanAll(ctx, "s:*", func(key string) error {
+		keys = append(keys, key)
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, key := range keys {
+		select {
+		case <-ctx.Done():
+			return n, ctx.Err()
+		default:
+		}
+
+		ok, err := migrateScript.Run(s.client, []string{key}).Int64()
+		if err != nil {
+			return n, err
+		}
+		n += int(ok)
+	}
+	return n, nil
+}
+
+// writes a batch, returns entries which failed because they were
+// written to legacy keys
+func (s *RedisStorage) write(batch *Batch) ([]Entry, error) {
+	pipes := s.pipelines()
+	defer pipes.Close()
+
+	cmds := make([]redis.Cmder, len(batch.Entries))
+	ttls := make(map[string]time.Duration, len(batch.Entries))
+	indexTTLs := make(map[string]time.Duration)
+	for n, ent := range batch.Entries {
+		key := s.key(ent.Key)
+		pipe := pipes.For(key)
+
+		field := fmt.Sprintf("%04d", ent.Minute)
+		if batch.Incr {
+			cmds[n] = pipe.HIncrBy(key, field, ent.Value)
+		} else {
+			cmds[n] = pipe.HSet(key, field, ent.Value)
+		}
+		ttls[key] = ent.TTL
+
+		day := seriesDay(ent.Key)
+		for _, index := range ent.Index {
+			name := s.key(dayIndex(index, day))
+			if _, ok := indexTTLs[name]; !ok {
+				s.addDay(pipes, index, day)
+			}
+			pipes.For(name).SAdd(name, ent.Key)
+			extendTTL(indexTTLs, name, ent.TTL)
+			extendTTL(indexTTLs, s.key(dayList(index)), ent.TTL)
+		}
+	}
+
+	for key, ttl := range ttls {
+		if ttl > 0 {
+			pipes.For(key).Expire(key, ttl)
+		}
+	}
+	s.expireIndex(pipes, indexTTLs)
+
+	err := pipes.Exec()
+	if err == nil {
+		return nil, nil
+	}
+
+	var failed []Entry
+	for n, cmd := range cmds {
+		if err := cmd.Err(); isWrongType(err) {
+			failed = append(failed, batch.Entries[n])
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if len(failed) == 0 {
+		return nil, err
+	}
+	return failed, nil
+}
+
+// Remove implements Storage.
+func (s *RedisStorage) Remove(ctx context.Context, removals []Removal) error {
+	// legacy keys must be converted before fields can be removed
+	for _, rem := range removals {
+		if len(rem.Minutes) == 0 {
+			continue
+		}
+		if err := s.migrate(rem.Key); err != nil {
+			return err
+		}
+	}
+
+	pipes := s.pipelines()
+	defer pipes.Close()
+
+	var partial []Removal
+	for _, rem := range removals {
+		key := s.key(rem.Key)
+		if len(rem.Minutes) == 0 {
+			pipes.For(key).Del(key)
+			s.unindex(pipes, rem)
+			continue
+		}
+
+		fields := make([]string, 0, len(rem.Minutes))
+		for _, minute := range rem.Minutes {
+			fields = append(fields, fmt.Sprintf("%04d", minute))
+		}
+		pipes.For(key).HDel(key, fields...)
+		partial = append(partial, rem)
+	}
+	if err := pipes.Exec(); err != nil || len(partial) == 0 {
+		return err
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
+
+	// remove emptied keys from their index sets
+	exists := make([]*redis.IntCmd, len(partial))
+	for n, rem := range partial {
+		key := s.key(rem.Key)
+		exists[n] = pipes.For(key).Exists(key)
+	}
+	if err := pipes.Exec(); err != nil {
+		return err
+	}
+
+	empty := false
+	for n, rem := range partial {
+		if exists[n].Val() == 0 {
+			s.unindex(pipes, rem)
+			empty = true
+		}
+	}
+	if !empty {
+		return nil
+	}
+	return pipes.Exec()
+}
+
+// unindex queues the removal of a key from its index sets, including
+// unconverted sets of earlier versions
+func (s *RedisStorage) unindex(pipes *pipelines, rem Removal) {
+	day := seriesDay(rem.Key)
+	for _, index := range rem.Index {
+		for _, name := range []string{s.key(dayIndex(index, day)), s.key(index)} {
+			pipes.For(name).SRem(name, rem.Key)
+		}
+		s.pruneDay(pipes, s.key(dayIndex(index, day)))
+	}
+}
+
+// removes the day of a day index set from the day list of its index once the
+// set is empty, other index sets are ignored
+func (s *RedisStorage) pruneDay(pipes *pipelines, name string) {
+	logical := s.logicalKey(name)
+	piv := strings.LastIndexByte(logical, ':')
+	if len(logical) < 3 || logical[1] != 'd' || logical[2] != ':' || piv < 3 {
+		return
+	}
+
+	index := logical[:1] + logical[2:piv]
+	pruneScript.Eval(pipes.For(name), []string{name, s.key(dayList(index))}, logical[piv+1:])
+}
+
+// migrate converts a single legacy key
+func (s *RedisStorage) migrate(key string) error {
+	return migrateScript.Run(s.client, []string{s.key(key)}).Err()
+}
+
+// ReadMeta implements Storage.
+func (s *RedisStorage) ReadMeta(_ context.Context, name string) (map[string]string, error) {
+	return s.client.HGetAll("meta:" + name).Result()
+}
+
+// WriteMeta implements Storage.
+func (s *RedisStorage) WriteMeta(name, field, value string) error {
+	if value == "" {
+		return s.client.HDel("meta:"+name, field).Err()
+	}
+	return s.client.HSet("meta:"+name, field, value).Err()
+}
+
+// ScanIndex implements Storage. Only the day index sets between minDay and
+// maxDay are read.
+func (s *RedisStorage) ScanIndex(ctx context.Context, index string, minDay, maxDay int64, fn func(string) error) error {
+	names, err := s.dayIndexNames(ctx, index, minDay, maxDay)
+	if err != nil {
+		return err
+	}
+
+	pipes := s.pipelines()
+	defer pipes.Close()
+
+	cmds := make([]*redis.StringSliceCmd, len(names))
+	for n, name := range names {
+		cmds[n] = pipes.For(name).SMembers(name)
+	}
+	legacy := s.key(index)
+	exists := pipes.For(legacy).Exists(legacy)
+	if err := pipes.Exec(); err != nil {
+		return err
+	}
+
+	for _, cmd := range cmds {
+		for _, member := range cmd.Val() {
+			if err := fn(member); err != nil {
+				return err
+			}
+		}
+	}
+	if exists.Val() == 0 {
+		return nil
+	}
+
+	iter := s.client.SScan(legacy, 0, "", 1000).Iterator()
+	for iter.Next() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		if err := fn(iter.Val()); err != nil {
+			return err
+		}
+	}
+	return iter.Err()
+}
+
+// dayIndexNames returns the physical names of the day index sets between
+// minDay and maxDay. Days of wide ranges are read from the day list of the
+// index.
+func (s *RedisStorage) dayIndexNames(_ context.Context, index string, minDay, maxDay int64) ([]string, error) {
+	if maxDay-minDay < maxIndexDays {
+		names := make([]string, 0, maxDay-minDay+1)
+		for day := minDay; day <= maxDay; day++ {
+			names = append(names, s.key(dayIndex(index, day)))
+		}
+		return names, nil
+	}
+
+	days, err := s.client.ZRangeByScore(s.key(dayList(index)), redis.ZRangeBy{
+		Min: strconv.FormatInt(minDay, 10),
+		Max: strconv.FormatInt(maxDay, 10),
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(days))
+	for _, day := range days {
+		names = append(names, s.key(dayIndexPrefix(index)+day))
+	}
+	return names, nil
+}
+
+// adds a day to the day list of an index
+func (s *RedisStorage) addDay(pipes *pipelines, index string, day int64) {
+	list := s.key(dayList(index))
+	pipes.For(list).ZAdd(list, redis.Z{Score: float64(day), Member: strconv.FormatInt(day, 10)})
+}
+
+// extends the TTLs of day index sets and lists, sets are shared by series
+// of different retention
+func (s *RedisStorage) expireIndex(pipes *pipelines, ttls map[string]time.Duration) {
+	for name, ttl := range ttls {
+		if ttl > 0 {
+			extendScript.Eval(pipes.For(name), []string{name}, int64(ttl/time.Millisecond))
+		} else {
+			pipes.For(name).Persist(name)
+		}
+	}
+}
+
+// MigrateIndex converts all index sets of earlier versions into day index
+// sets. It should be run once all writers have been upgraded. It returns the
+// number of converted sets.
+func (s *RedisStorage) MigrateIndex(ctx context.Context) (int, error) {
+	var names []string
+	if err := s.scanAll(ctx, "[mt]:*", func(name string) error {
+		names = append(names, name)
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+
+	for n, name := range names {
+		if err := s.migrateIndex(ctx, name); err != nil {
+			return n, err
+		}
+	}
+	return len(names), nil
+}
+
+// migrateIndex moves the members of an index set of an earlier version into
+// day index sets. Day index sets expire with their last series, members
+// which no longer exist are dropped.
+func (s *RedisStorage) migrateIndex(ctx context.Context, name string) error {
+	index := s.logicalKey(name)
+	ttls := make(map[string]time.Duration)
+
+	// adds a batch of members to their day index sets
+	migrate := func(members []string) error {
+		pipes := s.pipelines()
+		defer pipes.Close()
+
+		cmds := make([]*redis.DurationCmd, len(members))
+		for n, member := range members {
+			key := s.key(member)
+			cmds[n] = pipes.For(key).PTTL(key)
+		}
+		if err := pipes.Exec(); err != nil {
+			return err
+		}
+
+		for n, member := range members {
+			ttl := cmds[n].Val()
+			if ttl == -2*time.Millisecond {
+				continue // missing
+			}
+
+			day := seriesDay(member)
+			set := s.key(dayIndex(index, day))
+			if _, ok := ttls[set]; !ok {
+				s.addDay(pipes, index, day)
+			}
+			pipes.For(set).SAdd(set, member)
+			extendTTL(ttls, set, ttl)
+			extendTTL(ttls, s.key(dayList(index)), ttl)
+		}
+		return pipes.Exec()
+	}
+
+	members := make([]string, 0, 1000)
+	iter := s.client.SScan(name, 0, "", 1000).Iterator()
+	for iter.Next() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		member := iter.Val()
+		if _, err := parseSeries(member); err != nil {
+			continue
+		}
+
+		if members = append(members, member); len(members) == cap(members) {
+			if err := migrate(members); err != nil {
+				return err
+			}
+			members = members[:0]
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	if err := migrate(members); err != nil {
+		return err
+	}
+
+	pipes := s.pipelines()
+	defer pipes.Close()
+
+	s.expireIndex(pipes, ttls)
+	pipes.For(name).Del(name)
+	return pipes.Exec()
+}
+
+// ReadSeries implements Storage. Short ranges are read field by field,
+// longer ones in full.
+func (s *RedisStorage) ReadSeries(ctx context.Context, ranges []SeriesRange, fn func(string, int, int64) error) error {
+	pipes := s.pipelines()
+	defer pipes.Close()
+
+	cmds := make([]redis.Cmder, len(ranges))
+	for n, r := range ranges {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		key := s.key(r.Key)
+		if r.Max-r.Min+1 < minutesPerDay/2 {
+			fields := make([]string, 0, r.Max-r.Min+1)
+			for minute := r.Min; minute <= r.Max; minute++ {
+				fields = append(fields, fmt.Sprintf("%04d", minute))
+			}
+			cmds[n] = pipes.For(key).HMGet(key, fields...)
+		} else {
+			cmds[n] = pipes.For(key).HGetAll(key)
+		}
+	}
+	_ = pipes.Exec()
+
+	var legacy []SeriesRange
+	for n, r := range ranges {
+		if isWrongType(cmds[n].Err()) {
+			legacy = append(legacy, r)
+			continue
+		}
+
+		switch cmd := cmds[n].(type) {
+		case *redis.SliceCmd:
+			vals, err := cmd.Result()
+			if err != nil {
+				return err
+			}
+
+			for i, val := range vals {
+				str, ok := val.(string)
+				if !ok {
+					continue
+				}
+				value, err := strconv.ParseInt(str, 10, 64)
+				if err != nil {
+					return err
+				}
+				if err := fn(r.Key, r.Min+i, value); err != nil {
+					return err
+				}
+			}
+		case *redis.StringStringMapCmd:
+			fields, err := cmd.Result()
+			if err != nil {
+				return err
+			}
+
+			for field, str := range fields {
+				minute, _ := strconv.Atoi(field)
+				if !r.Contains(minute) {
+					continue
+				}
+				value, err := strconv.ParseInt(str, 10, 64)
+				if err != nil {
+					return err
+				}
+				if err := fn(r.Key, minute, value); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	if len(legacy) != 0 {
+		return s.readLegacySeries(ctx, legacy, fn)
+	}
+	return nil
+}
+
+// reads series stored as sorted sets, scores are values so these cannot be
+// restricted to ranges on the server
+func (s *RedisStorage) readLegacySeries(ctx context.Context, ranges []SeriesRange, fn func(string, int, int64) error) error {
+	pipes := s.pipelines()
+	defer pipes.Close()
+
+	cmds := make([]*redis.ZSliceCmd, len(ranges))
+	for n, r := range ranges {
+		key := s.key(r.Key)
+		cmds[n] = pipes.For(key).ZRangeWithScores(key, 0, -1)
+	}
+	_ = pipes.Exec()
+
+	for n, r := range ranges {
+		pairs, err := cmds[n].Result()
+		if err != nil {
+			return err
+		}
+
+		for _, pair := range pairs {
+			minute, _ := strconv.Atoi(pair.Member.(string))
+			if !r.Contains(minute) {
+				continue
+			}
+			if err := fn(r.Key, minute, int64(pair.Score)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// SumSeries implements SeriesSummer. Values are summed by a Lua script,
+// ErrUnsupported is returned if scripts cannot be run or sums would be
+// inexact. Other errors are returned unchanged.
+func (s *RedisStorage) SumSeries(ctx context.Context, ranges []SeriesRange, step, phase int, fn func(string, int, int64) error) error {
+	pipes := s.pipelines()
+	defer pipes.Close()
+
+	cmds := make([]*redis.Cmd, len(ranges))
+	for n, r := range ranges {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		key := s.key(r.Key)
+		cmds[n] = sumScript.EvalSha(pipes.For(key), []string{key}, r.Min, r.Max, step, phase)
+	}
+	_ = pipes.Exec()
+
+	// send the script source to nodes which have not cached it yet
+	retry := false
+	for n, r := range ranges {
+		if isNoScript(cmds[n].Err()) {
+			key := s.key(r.Key)
+			cmds[n] = sumScript.Eval(pipes.For(key), []string{key}, r.Min, r.Max, step, phase)
+			retry = true
+		}
+	}
+	if retry {
+		_ = pipes.Exec()
+	}
+
+	// collect all sums first, so fn is not called if any script failed
+	type bucket struct {
+		minute int
+		sum    int64
+	}
+	buckets := make([][]bucket, len(ranges))
+	for n := range ranges {
+		res, err := cmds[n].Result()
+		if isUnsupportedScript(err) {
+			return ErrUnsupported
+		} else if err != nil {
+			return err
+		}
+
+		pairs, ok := res.([]interface{})
+		if !ok || len(pairs)%2 != 0 {
+			return ErrUnsupported
+		}
+		for i := 0; i+1 < len(pairs); i += 2 {
+			minute, ok1 := pairs[i].(int64)
+			sum, ok2 := pairs[i+1].(int64)
+			if !ok1 || !ok2 {
+				return ErrUnsupported
+			}
+			buckets[n] = append(buckets[n], bucket{minute: int(minute), sum: sum})
+		}
+	}
+
+	for n, r := range ranges {
+		for _, b := range buckets[n] {
+			if err := fn(r.Key, b.minute, b.sum); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// CompactIndex implements Storage. Unless full is set, a single SCAN step
+// is performed and only a random sample of members is inspected per index
+// set; the cycle wraps when the SCAN cursor returns to the start.
+func (s *RedisStorage) CompactIndex(ctx context.Context, expired func(string) (bool, error), full bool) (*CompactStats, error) {
+	if full {
+		return s.compactFull(ctx, expired)
+	}
+
+	keys, wrapped, err := s.scanIndexNames()
+	if err != nil {
+		return nil, err
+	}
+
+	pipes := s.pipelines()
+	defer pipes.Close()
+
+	stats := &CompactStats{Wrapped: wrapped}
+	cmds := make([]*redis.IntCmd, 0, len(keys))
+	for _, key := range keys {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		default:
+		}
+
+		members, err := s.client.SRandMemberN(key, 100).Result()
+		if err != nil {
+			return nil, err
+		}
+		stats.KeysScanned++
+
+		n := len(cmds)
+		for _, member := range members {
+			if ok, err := expired(member); err != nil {
+				return nil, err
+			} else if ok {
+				cmds = append(cmds, pipes.For(key).SRem(key, member))
+			}
+		}
+		if len(cmds) != n {
+			s.pruneDay(pipes, key)
+		}
+	}
+
+	if len(cmds) == 0 {
+		return stats, nil
+	}
+	if err := pipes.Exec(); err != nil {
+		return nil, err
+	}
+	for _, cmd := range cmds {
+		stats.MembersRemoved += int(cmd.Val())
+	}
+	return stats, nil
+}
+
+// compactFull iterates over all members of all index sets and removes
+// expired ones.
+func (s *RedisStorage) compactFull(ctx context.Context, expired func(string) (bool, error)) (*CompactStats, error) {
+	stats := &CompactStats{Wrapped: true}
+	err := s.scanAll(ctx, indexPattern, func(key string) error {
+		stats.KeysScanned++
+
+		stale := make([]interface{}, 0, 100)
+		flush := func() error {
+			if len(stale) == 0 {
+				return nil
+			}
+			n, err := s.client.SRem(key, stale...).Result()
+			if err != nil {
+				return err
+			}
+			stats.MembersRemoved += int(n)
+			stale = stale[:0]
+			return nil
+		}
+
+		removed := stats.MembersRemoved
+		iter := s.client.SScan(key, 0, "", 1000).Iterator()
+		for iter.Next() {
+			if ok, err := expired(iter.Val()); err != nil {
+				return err
+			} else if ok {
+				stale = append(stale, iter.Val())
+			}
+			if len(stale) == cap(stale) {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+		}
+		if err := iter.Err(); err != nil {
+			return err
+		}
+		if err := flush(); err != nil || stats.MembersRemoved == removed {
+			return err
+		}
+
+		pipes := s.pipelines()
+		defer pipes.Close()
+
+		s.pruneDay(pipes, key)
+		return pipes.Exec()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// scanIndexNames performs a single SCAN step to retrieve index set names. On
+// a cluster, a step is performed on every master. It reports whether the
+// SCAN cycle has completed.
+func (s *RedisStorage) scanIndexNames() ([]string, bool, error) {
+	cluster, ok := s.client.(*redis.ClusterClient)
+	if !ok {
+		keys, cursor, err := s.client.Scan(atomic.LoadUint64(&s.cursor), indexPattern, 20).Result()
+		if err != nil {
+			return nil, false, err
+		}
+		atomic.StoreUint64(&s.cursor, cursor)
+		return keys, cursor == 0, nil
+	}
+
+	// masters which complete their cycle early are skipped until all
+	// masters have completed theirs
+	var keys []string
+	var masters, done int
+	err := cluster.ForEachMaster(func(client *redis.Client) error {
+		addr := client.Options().Addr
+
+		s.mu.Lock()
+		cursor, skip := s.cursors[addr], s.wrapped[addr]
+		masters++
+		if skip {
+			done++
+		}
+		s.mu.Unlock()
+
+		if skip {
+			return nil
+		}
+
+		part, cursor, err := client.Scan(cursor, indexPattern, 20).Result()
+		if err != nil {
+			return err
+		}
+
+		s.mu.Lock()
+		s.cursors[addr] = cursor
+		if cursor == 0 {
+			s.wrapped[addr] = true
+			done++
+		}
+		keys = append(keys, part...)
+		s.mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	wrapped := done == masters
+	if wrapped {
+		s.mu.Lock()
+		s.wrapped = make(map[string]bool)
+		s.mu.Unlock()
+	}
+	return keys, wrapped, nil
+}
+
+// scanAll iterates over all keys matching pattern. On a cluster, all masters
+// are scanned.
+func (s *RedisStorage) scanAll(ctx context.Context, pattern string, fn func(string) error) error {
+	scan := func(client redis.Cmdable, fn func(string) error) error {
+		iter := client.Scan(0, pattern, 1000).Iterator()
+		for iter.Next() {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			default:
+			}
+
+			if err := fn(iter.Val()); err != nil {
+				return err
+			}
+		}
+		return iter.Err()
+	}
+
+	cluster, ok := s.client.(*redis.ClusterClient)
+	if !ok {
+		return scan(s.client, fn)
+	}
+
+	var mu sync.Mutex
+	return cluster.ForEachMaster(func(client *redis.Client) error {
+		return scan(client, func(key string) error {
+			mu.Lock()
+			defer mu.Unlock()
+			return fn(key)
+		})
+	})
+}
+
+// key translates a key name into the physical key name.
+func (s *RedisStorage) key(name string) string {
+	if !s.cluster || len(name) < 2 {
+		return name
+	}
+
+	switch name[:2] {
+	case "s:":
+		rest := name[2:]
+		end := strings.IndexByte(rest, ',')
+		if end < 0 {
+			end = strings.LastIndexByte(rest, ':')
+		}
+		if end < 0 {
+			return name
+		}
+		return "s:{" + rest[:end] + "}" + rest[end:]
+	case "m:", "t:":
+		return name[:2] + "{" + name[2:] + "}"
+	case "ml", "tl":
+		if len(name) < 3 || name[2] != ':' {
+			return name
+		}
+		return name[:3] + "{" + name[3:] + "}"
+	case "md", "td":
+		piv := strings.LastIndexByte(name, ':')
+		if len(name) < 3 || name[2] != ':' || piv < 3 {
+			return name
+		}
+		return name[:3] + "{" + name[3:piv] + "}" + name[piv:]
+	}
+	return name
+}
+
+// logicalKey translates a physical key name into the key name.
+func (s *RedisStorage) logicalKey(name string) string {
+	if !s.cluster {
+		return name
+	}
+	if i := strings.IndexByte(name, '{'); i > -1 {
+		if j := strings.IndexByte(name[i:], '}'); j > -1 {
+			return name[:i] + name[i+1:i+j] + name[i+j+1:]
+		}
+	}
+	return name
+}
+
+func (s *RedisStorage) pipelines() *pipelines {
+	return &pipelines{client: s.client, nodes: s.slotNodes(), pipes: make(map[string]redis.Pipeliner, 1)}
+}
+
+// slotNodes returns the master node address of each slot, if connected to
+// a cluster. The mapping is reloaded every slotRefresh, it only affects how
+// commands are grouped, the client routes them to the current owner.
+func (s *RedisStorage) slotNodes() []string {
+	cluster, ok := s.client.(*redis.ClusterClient)
+	if !ok {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.nodes != nil && time.Since(s.loaded) < slotRefresh {
+		return s.nodes
+	}
+
+	slots, err := cluster.ClusterSlots().Result()
+	if err != nil {
+		return s.nodes
+	}
+
+	nodes := make([]string, numSlots)
+	for _, slot := range slots {
+		if len(slot.Nodes) == 0 || slot.Start < 0 || slot.End >= numSlots {
+			continue
+		}
+		for i := slot.Start; i <= slot.End; i++ {
+			nodes[i] = slot.Nodes[0].Addr
+		}
+	}
+	s.nodes, s.loaded = nodes, time.Now()
+	return nodes
+}
+
+// --------------------------------------------------------------------
+
+// matches day index sets and index sets of earlier versions
+const indexPattern = "[mt][:d]*"
+
+// interval at which the slot to node mapping of a cluster is reloaded
+const slotRefresh = time.Minute
+
+// day ranges of at least this length are read from the day list by
+// ScanIndex
+const maxIndexDays = 400
+
+// dayIndexPrefix returns the name prefix of the day index sets of an index,
+// e.g. md:cpu: for m:cpu
+func dayIndexPrefix(index string) string {
+	return index[:1] + "d" + index[1:] + ":"
+}
+
+// dayIndex returns the name of the index set of a day
+func dayIndex(index string, day int64) string {
+	return dayIndexPrefix(index) + strconv.FormatInt(day, 10)
+}
+
+// dayList returns the name of the sorted set of days with index sets of an
+// index, e.g. ml:cpu for m:cpu
+func dayList(index string) string {
+	return index[:1] + "l" + index[1:]
+}
+
+// extends the TTL of a key in ttls, TTLs of zero or less never expire
+func extendTTL(ttls map[string]time.Duration, key string, ttl time.Duration) {
+	if prev, ok := ttls[key]; !ok || prev > 0 && (ttl <= 0 || ttl > prev) {
+		ttls[key] = ttl
+	}
+}
+
+// seriesDay returns the unix day of a series key
+func seriesDay(key string) int64 {
+	day, _ := strconv.ParseInt(key[strings.LastIndexByte(key, ':')+1:], 10, 64)
+	return day
+}
+
+func isWrongType(err error) bool {
+	return err != nil && strings.HasPrefix(err.Error(), "WRONGTYPE")
+}
+
+func isNoScript(err error) bool {
+	return err != nil && strings.HasPrefix(err.Error(), "NOSCRIPT")
+}
+
+// isUnsupportedScript returns true if scripts cannot be run, or the sum
+// script could not sum exactly
+func isUnsupportedScript(err error) bool {
+	if err == nil {
+		return false
+	} else if isNoScript(err) {
+		return true
+	}
+
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "unknown command") ||
+		strings.Contains(msg, "disabled") ||
+		strings.Contains(msg, "not allowed") ||
+		strings.Contains(msg, "cntdb: inexact sum")
+}
+
+// pipelines maintains a pipeline per cluster master node, or a single
+// pipeline unless connected to a cluster.
+type pipelines struct {
+	client redis.UniversalClient
+	nodes  []string // master node addresses, by slot
+	pipes  map[string]redis.Pipeliner
+}
+
+// For returns the pipeline for a key.
+func (p *pipelines) For(key string) redis.Pipeliner {
+	node := ""
+	if p.nodes != nil {
+		node = p.nodes[hashSlot(key)]
+	}
+
+	pipe, ok := p.pipes[node]
+	if !ok {
+		pipe = p.client.Pipeline()
+		p.pipes[node] = pipe
+	}
+	return pipe
+}
+
+// Exec executes all pipelines in parallel.
+func (p *pipelines) Exec() error {
+	if len(p.pipes) == 1 {
+		for _, pipe := range p.pipes {
+			_, err := pipe.Exec()
+			return err
+		}
+	}
+
+	errs := make(chan error, len(p.pipes))
+	for _, pipe := range p.pipes {
+		go func(pipe redis.Pipeliner) {
+			_, err := pipe.Exec()
+			errs <- err
+		}(pipe)
+	}
+
+	var err error
+	for range p.pipes {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Close closes all pipelines.
+func (p *pipelines) Close() error {
+	var err error
+	for _, pipe := range p.pipes {
+		if e := pipe.Close(); e != nil {
+			err = e
+		}
+	}
+	return err
+}
@@ -0,0 +1,404 @@
+package cntdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("RedisStorage", func() {
+
+	Describe("series", func() {
+		var subject *DB
+		var client *redis.Client
+
+		BeforeEach(func() {
+			subject, client = openTestDB("2014-10-25T00:00:00Z")
+		})
+
+		AfterEach(func() {
+			closeTestDB(client)
+		})
+
+		It("should store exact values", func() {
+			Expect(subject.Increment([]Point{
+				point("cpu,a 1414141414 9007199254740993"),
+				point("cpu,a 1414141414 2"),
+			})).To(Succeed())
+			Expect(client.HGet("s:cpu,a:16367", "0543").Val()).To(Equal("9007199254740995"))
+
+			points, err := subject.QueryPoints(context.Background(), &Criteria{Metric: "cpu", From: xmltime("2014-10-24T09:00:00Z")})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(points).To(ConsistOf(point("cpu,a 1414141380 9007199254740995")))
+		})
+
+		It("should support legacy series", func() {
+			Expect(subject.Set([]Point{point("cpu,a 1414141414 1")})).To(Succeed())
+			Expect(client.Del("s:cpu,a:16367").Err()).NotTo(HaveOccurred())
+			Expect(client.ZAdd("s:cpu,a:16367", redis.Z{Member: "0543", Score: 4}, redis.Z{Member: "0544", Score: 8}).Err()).NotTo(HaveOccurred())
+			Expect(client.Expire("s:cpu,a:16367", time.Hour).Err()).NotTo(HaveOccurred())
+			Expect(client.ZAdd("s:cpu,b:16367", redis.Z{Member: "0543", Score: 16}).Err()).NotTo(HaveOccurred())
+			Expect(client.SAdd("m:cpu", "s:cpu,b:16367").Err()).NotTo(HaveOccurred())
+
+			query := func() ResultSet {
+				res, err := subject.Query(context.Background(), &Criteria{Metric: "cpu", From: xmltime("2014-10-24T09:00:00Z"), Interval: time.Hour})
+				Expect(err).NotTo(HaveOccurred())
+				return res
+			}
+			Expect(query()).To(Equal(ResultSet{{xmltime("2014-10-24T09:00:00Z"), 28, xmltime("2014-10-24T10:00:00Z")}}))
+
+			// convert on write
+			Expect(subject.Increment([]Point{point("cpu,a 1414141414 1")})).To(Succeed())
+			Expect(client.Type("s:cpu,a:16367").Val()).To(Equal("hash"))
+			Expect(client.HGetAll("s:cpu,a:16367").Val()).To(Equal(map[string]string{"0543": "5", "0544": "8"}))
+			Expect(client.Type("s:cpu,b:16367").Val()).To(Equal("zset"))
+			Expect(query()).To(Equal(ResultSet{{xmltime("2014-10-24T09:00:00Z"), 29, xmltime("2014-10-24T10:00:00Z")}}))
+
+			// migrate all
+			n, err := subject.store.(*RedisStorage).MigrateSeries(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(n).To(Equal(1))
+			Expect(client.Type("s:cpu,b:16367").Val()).To(Equal("hash"))
+			Expect(query()).To(Equal(ResultSet{{xmltime("2014-10-24T09:00:00Z"), 29, xmltime("2014-10-24T10:00:00Z")}}))
+		})
+
+		It("should read ranges", func() {
+			Expect(subject.Set([]Point{
+				point("cpu,a 1414108800 1"), // 2014-10-24T00:00:00Z
+				point("cpu,a 1414141380 2"), // 2014-10-24T09:03:00Z
+				point("cpu,a 1414141440 4"), // 2014-10-24T09:04:00Z
+				point("cpu,a 1414195140 8"), // 2014-10-24T23:59:00Z
+			})).To(Succeed())
+			Expect(client.ZAdd("s:cpu,b:16367", redis.Z{Member: "0543", Score: 16}, redis.Z{Member: "0600", Score: 32}).Err()).NotTo(HaveOccurred())
+
+			read := func(ranges ...SeriesRange) map[string]int64 {
+				values := make(map[string]int64)
+				Expect(subject.store.ReadSeries(context.Background(), ranges, func(key string, minute int, value int64) error {
+					values[fmt.Sprintf("%s/%d", key, minute)] = value
+					return nil
+				})).To(Succeed())
+				return values
+			}
+
+			Expect(read(FullDay("s:cpu,a:16367"))).To(Equal(map[string]int64{
+				"s:cpu,a:16367/0":    1,
+				"s:cpu,a:16367/543":  2,
+				"s:cpu,a:16367/544":  4,
+				"s:cpu,a:16367/1439": 8,
+			}))
+			Expect(read(SeriesRange{Key: "s:cpu,a:16367", Min: 540, Max: 543}, SeriesRange{Key: "s:cpu,b:16367", Min: 540, Max: 550})).To(Equal(map[string]int64{
+				"s:cpu,a:16367/543": 2,
+				"s:cpu,b:16367/543": 16,
+			}))
+			Expect(read(SeriesRange{Key: "s:cpu,a:16367", Min: 1, Max: 1439})).To(Equal(map[string]int64{
+				"s:cpu,a:16367/543":  2,
+				"s:cpu,a:16367/544":  4,
+				"s:cpu,a:16367/1439": 8,
+			}))
+			Expect(read(SeriesRange{Key: "s:cpu,c:16367", Min: 0, Max: 10})).To(BeEmpty())
+		})
+
+		It("should sum series", func() {
+			Expect(subject.Set([]Point{
+				point("cpu,a 1414108800 1"), // 2014-10-24T00:00:00Z
+				point("cpu,a 1414141380 2"), // 2014-10-24T09:03:00Z
+				point("cpu,a 1414141440 4"), // 2014-10-24T09:04:00Z
+				point("cpu,a 1414195140 8"), // 2014-10-24T23:59:00Z
+			})).To(Succeed())
+			Expect(client.ZAdd("s:cpu,b:16367", redis.Z{Member: "0543", Score: 16}, redis.Z{Member: "0600", Score: 32}).Err()).NotTo(HaveOccurred())
+
+			store := subject.store.(*RedisStorage)
+			sum := func(step, phase int, ranges ...SeriesRange) (map[string]int64, error) {
+				sums := make(map[string]int64)
+				err := store.SumSeries(context.Background(), ranges, step, phase, func(key string, minute int, sum int64) error {
+					sums[fmt.Sprintf("%s/%d", key, minute)] = sum
+					return nil
+				})
+				return sums, err
+			}
+
+			Expect(sum(60, 0, FullDay("s:cpu,a:16367"), FullDay("s:cpu,c:16367"))).To(Equal(map[string]int64{
+				"s:cpu,a:16367/0":    1,
+				"s:cpu,a:16367/540":  6,
+				"s:cpu,a:16367/1380": 8,
+			}))
+			Expect(sum(60, 15, SeriesRange{Key: "s:cpu,a:16367", Min: 541, Max: 1439})).To(Equal(map[string]int64{
+				"s:cpu,a:16367/541":  6,
+				"s:cpu,a:16367/1395": 8,
+			}))
+			Expect(sum(1440, 0, FullDay("s:cpu,b:16367"), SeriesRange{Key: "s:cpu,a:16367", Min: 540, Max: 600})).To(Equal(map[string]int64{
+				"s:cpu,a:16367/540": 6,
+				"s:cpu,b:16367/0":   48,
+			}))
+
+			// cannot sum exactly
+			Expect(subject.Increment([]Point{point("cpu,a 1414108800 9007199254740993")})).To(Succeed())
+			_, err := sum(60, 0, FullDay("s:cpu,a:16367"))
+			Expect(err).To(Equal(ErrUnsupported))
+		})
+
+		It("should pass through other errors when summing", func() {
+			store := NewRedisStorage(redis.NewClient(&redis.Options{Addr: "127.0.0.1:1"}))
+			store.owned = true
+			defer store.Close()
+
+			err := store.SumSeries(context.Background(), []SeriesRange{FullDay("s:cpu,a:16367")}, 60, 0, func(string, int, int64) error {
+				return nil
+			})
+			Expect(err).To(HaveOccurred())
+			Expect(err).NotTo(Equal(ErrUnsupported))
+
+			Expect(isUnsupportedScript(errors.New("NOSCRIPT No matching script"))).To(BeTrue())
+			Expect(isUnsupportedScript(errors.New("ERR unknown command 'EVALSHA'"))).To(BeTrue())
+			Expect(isUnsupportedScript(errors.New("ERR Error running script: cntdb: inexact sum"))).To(BeTrue())
+			Expect(isUnsupportedScript(errors.New("LOADING Redis is loading the dataset in memory"))).To(BeFalse())
+		})
+
+		It("should aggregate on the server", func() {
+			Expect(subject.Set([]Point{
+				point("cpu,a,b 1414141200 1"),  // 2014-10-24T09:00:00Z
+				point("cpu,a,c 1414141300 2"),  // 2014-10-24T09:01:40Z
+				point("cpu,a,c 1414142000 4"),  // 2014-10-24T09:13:20Z
+				point("cpu,b,c 1414146000 8"),  // 2014-10-24T10:20:00Z
+				point("cpu,a,b 1414200000 16"), // 2014-10-25T01:20:00Z
+			})).To(Succeed())
+
+			berlin, _ := time.LoadLocation("Europe/Berlin")
+			criteria := []*Criteria{
+				{Metric: "cpu", From: xmltime("2014-10-24T09:00:00Z"), Interval: time.Hour},
+				{Metric: "cpu", From: xmltime("2014-10-24T09:05:00Z"), Interval: 10 * time.Minute, Offset: 5 * time.Minute},
+				{Metric: "cpu", From: xmltime("2014-10-24T00:00:00Z"), Calendar: CalendarDay},
+				{Metric: "cpu", From: xmltime("2014-10-24T00:00:00Z"), Calendar: CalendarDay, Location: berlin},
+				{Metric: "cpu", From: xmltime("2014-10-24T09:00:00Z"), Interval: 7 * time.Minute, Tags: []string{"a"}},
+				{Metric: "cpu", From: xmltime("2014-10-24T09:00:00Z"), Interval: time.Hour, Aggregate: AggMax},
+				{Metric: "cpu", From: xmltime("2014-10-24T09:00:00Z"), Interval: time.Hour, GroupBy: []string{"b"}},
+			}
+
+			query := func() [][]Group {
+				var res [][]Group
+				for _, c := range criteria {
+					groups, err := subject.QueryGrouped(context.Background(), c)
+					Expect(err).NotTo(HaveOccurred(), "for %+v", c)
+					res = append(res, groups)
+				}
+				return res
+			}
+
+			expected := query()
+			subject.SetServerAggregation(true)
+			Expect(query()).To(Equal(expected))
+
+			// fall back for inexact sums
+			Expect(subject.Increment([]Point{point("cpu,a,b 1414141200 9007199254740993")})).To(Succeed())
+			res, err := subject.Query(context.Background(), criteria[0])
+			Expect(err).NotTo(HaveOccurred())
+			Expect(res[0].Value).To(Equal(int64(9007199254741000)))
+		})
+
+		It("should scan day index sets", func() {
+			Expect(subject.Set([]Point{
+				point("cpu,a 1414141414 1"),
+				point("cpu,a 1414241414 2"),
+				point("cpu:x,a 1414141414 4"),
+			})).To(Succeed())
+			Expect(client.PTTL("md:cpu:16367").Val()).To(Equal(client.PTTL("s:cpu,a:16367").Val()))
+			Expect(client.PTTL("td:a:16368").Val()).To(Equal(client.PTTL("s:cpu,a:16368").Val()))
+
+			// index sets shared with shorter-lived series keep their TTL
+			ttl := client.PTTL("td:a:16367").Val()
+			Expect(subject.store.Write(&Batch{Entries: []Entry{
+				{Key: "s:mem,a:16367", Minute: 1, Value: 1, Index: []string{"m:mem", "t:a"}, TTL: time.Hour},
+			}})).To(Succeed())
+			Expect(client.PTTL("td:a:16367").Val()).To(BeNumerically("~", ttl, time.Second))
+			Expect(client.PTTL("md:mem:16367").Val()).To(BeNumerically("~", time.Hour, time.Second))
+
+			scan := func(minDay, maxDay int64) []string {
+				var keys []string
+				Expect(subject.store.ScanIndex(context.Background(), "m:cpu", minDay, maxDay, func(key string) error {
+					keys = append(keys, key)
+					return nil
+				})).To(Succeed())
+				return keys
+			}
+			Expect(scan(16367, 16367)).To(ConsistOf("s:cpu,a:16367"))
+			Expect(scan(16367, 16368)).To(ConsistOf("s:cpu,a:16367", "s:cpu,a:16368"))
+			Expect(scan(16368, 20000)).To(ConsistOf("s:cpu,a:16368"))
+			Expect(scan(0, 20000)).To(ConsistOf("s:cpu,a:16367", "s:cpu,a:16368"))
+		})
+
+		It("should migrate index sets", func() {
+			Expect(client.SAdd("m:cpu", "s:cpu,a:16367", "s:cpu,a:16368", "s:cpu,b:16367").Err()).NotTo(HaveOccurred())
+			Expect(client.SAdd("t:a", "s:cpu,a:16367", "s:cpu,a:16368").Err()).NotTo(HaveOccurred())
+			Expect(client.HSet("s:cpu,a:16367", "0543", 1).Err()).NotTo(HaveOccurred())
+			Expect(client.HSet("s:cpu,a:16368", "0543", 2).Err()).NotTo(HaveOccurred())
+			Expect(client.HSet("s:cpu,b:16367", "0543", 4).Err()).NotTo(HaveOccurred())
+			Expect(client.Expire("s:cpu,a:16367", time.Hour).Err()).NotTo(HaveOccurred())
+			Expect(client.Expire("s:cpu,b:16367", 2*time.Hour).Err()).NotTo(HaveOccurred())
+
+			query := func() ResultSet {
+				res, err := subject.Query(context.Background(), &Criteria{Metric: "cpu", Tags: []string{"a"}, From: xmltime("2014-10-24T09:00:00Z"), Interval: 24 * time.Hour})
+				Expect(err).NotTo(HaveOccurred())
+				return res
+			}
+			Expect(query()).To(Equal(ResultSet{
+				{xmltime("2014-10-24T00:00:00Z"), 1, xmltime("2014-10-25T00:00:00Z")},
+				{xmltime("2014-10-25T00:00:00Z"), 2, xmltime("2014-10-26T00:00:00Z")},
+			}))
+
+			// invalid and missing members are skipped
+			Expect(client.SAdd("t:a", "bad", "s:cpu,c:16367").Err()).NotTo(HaveOccurred())
+
+			n, err := subject.store.(*RedisStorage).MigrateIndex(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(n).To(Equal(2))
+			Expect(client.Keys("[mt]*:*").Val()).To(ConsistOf("md:cpu:16367", "md:cpu:16368", "td:a:16367", "td:a:16368", "ml:cpu", "tl:a"))
+			Expect(client.SMembers("md:cpu:16367").Val()).To(ConsistOf("s:cpu,a:16367", "s:cpu,b:16367"))
+			Expect(client.SMembers("td:a:16367").Val()).To(ConsistOf("s:cpu,a:16367"))
+			Expect(client.SMembers("td:a:16368").Val()).To(ConsistOf("s:cpu,a:16368"))
+			Expect(client.ZRange("tl:a", 0, -1).Val()).To(Equal([]string{"16367", "16368"}))
+
+			// day index sets expire with their last series
+			Expect(client.TTL("md:cpu:16367").Val()).To(BeNumerically("~", 2*time.Hour, time.Second))
+			Expect(client.TTL("td:a:16367").Val()).To(BeNumerically("~", time.Hour, time.Second))
+			Expect(client.TTL("td:a:16368").Val()).To(Equal(-time.Second))
+			Expect(client.TTL("tl:a").Val()).To(Equal(-time.Second))
+			Expect(query()).To(Equal(ResultSet{
+				{xmltime("2014-10-24T00:00:00Z"), 1, xmltime("2014-10-25T00:00:00Z")},
+				{xmltime("2014-10-25T00:00:00Z"), 2, xmltime("2014-10-26T00:00:00Z")},
+			}))
+		})
+	})
+
+	Describe("cluster layout", func() {
+		var subject *DB
+		var client *redis.Client
+
+		BeforeEach(func() {
+			client = redis.NewClient(&redis.Options{Addr: "localhost:6379", DB: 9})
+			subject = NewClusterDB(client)
+			subject.now = fixedClock("2014-10-25T00:00:00Z")
+		})
+
+		AfterEach(func() {
+			closeTestDB(client)
+		})
+
+		It("should write hash-tagged keys", func() {
+			Expect(subject.Set([]Point{
+				point("cpu,host:a,dc:x 1414141414 2"),
+				point("cpu,host:b,dc:x 1414141414 3"),
+				point("mem,host:a 1414141414 1"),
+			})).To(Succeed())
+
+			Expect(client.Keys("*").Val()).To(ConsistOf([]string{
+				"s:{cpu},dc:x,host:a:16367",
+				"s:{cpu},dc:x,host:b:16367",
+				"s:{mem},host:a:16367",
+				"md:{cpu}:16367",
+				"md:{mem}:16367",
+				"td:{host:a}:16367",
+				"td:{host:b}:16367",
+				"td:{dc:x}:16367",
+				"ml:{cpu}",
+				"ml:{mem}",
+				"tl:{host:a}",
+				"tl:{host:b}",
+				"tl:{dc:x}",
+			}))
+			Expect(client.SMembers("md:{cpu}:16367").Val()).To(ConsistOf([]string{"s:cpu,dc:x,host:a:16367", "s:cpu,dc:x,host:b:16367"}))
+			Expect(client.SMembers("td:{host:a}:16367").Val()).To(ConsistOf([]string{"s:cpu,dc:x,host:a:16367", "s:mem,host:a:16367"}))
+			Expect(hashSlot("s:{cpu},dc:x,host:a:16367")).To(Equal(hashSlot("md:{cpu}:16367")))
+		})
+
+		It("should translate keys", func() {
+			store := subject.store.(*RedisStorage)
+			for _, key := range []string{"s:cpu,a,b:16367", "s:cpu:16367", "m:cpu", "t:host:a", "md:cpu:16367", "td:host:a:16367", "md:cpu:", "ml:cpu", "tl:host:a"} {
+				Expect(store.logicalKey(store.key(key))).To(Equal(key))
+			}
+		})
+
+		It("should query", func() {
+			Expect(subject.Set([]Point{
+				point("cpu,a,b 1414141200 1"),
+				point("cpu,a,c 1414141300 2"),
+				point("cpu,b,c 1414146000 8"),
+				point("mem,a,c 1414141200 64"),
+			})).To(Succeed())
+
+			res, err := subject.Query(context.Background(), &Criteria{
+				Metric:   "cpu",
+				Tags:     []string{"a"},
+				From:     xmltime("2014-10-24T09:00:00Z"),
+				Until:    xmltime("2014-10-24T11:00:00Z"),
+				Interval: time.Hour,
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(res).To(Equal(ResultSet{
+				{xmltime("2014-10-24T09:00:00Z"), 3, xmltime("2014-10-24T10:00:00Z")},
+			}))
+		})
+
+		It("should compact", func() {
+			Expect(subject.Set([]Point{
+				point("cpu,a 1414141414 1"),
+				point("cpu,b 1818181818 2"),
+			})).To(Succeed())
+			subject.now = fixedClock("2015-01-01T00:00:00Z")
+			Expect(subject.Compact(context.Background())).To(Succeed())
+			Expect(client.Keys("[mt]d:*").Val()).To(ConsistOf([]string{"md:{cpu}:21043", "td:{b}:21043"}))
+		})
+	})
+
+	It("should close owned clients only", func() {
+		owned := NewDBWithOptions(&redis.Options{Addr: "localhost:6379", DB: 9, PoolSize: 2})
+		client := owned.store.(*RedisStorage).client
+		Expect(owned.Close()).To(Succeed())
+		Expect(client.Ping().Err()).To(HaveOccurred())
+
+		external := redis.NewClient(&redis.Options{Addr: "localhost:6379", DB: 9})
+		defer external.Close()
+		Expect(NewDBWithClient(external).Close()).To(Succeed())
+		Expect(external.Ping().Err()).NotTo(HaveOccurred())
+	})
+
+	It("should calculate hash slots", func() {
+		Expect(hashSlot("123456789")).To(Equal(12739))
+		Expect(hashSlot("foo")).To(Equal(12182))
+		Expect(hashSlot("{user1000}.following")).To(Equal(hashSlot("{user1000}.followers")))
+		Expect(hashSlot("foo{}{bar}")).To(Equal(int(crc16("foo{}{bar}") % numSlots)))
+	})
+
+	It("should pipeline by cluster node", func() {
+		client := redis.NewClient(&redis.Options{Addr: "localhost:6379", DB: 9})
+		defer closeTestDB(client)
+
+		nodes := make([]string, numSlots)
+		for i := range nodes {
+			nodes[i] = "a"
+			if i >= numSlots/2 {
+				nodes[i] = "b"
+			}
+		}
+		pipes := &pipelines{client: client, nodes: nodes, pipes: make(map[string]redis.Pipeliner)}
+		defer pipes.Close()
+
+		// foo and 123456789 are in the upper half, bar in the lower one
+		Expect(pipes.For("foo")).To(BeIdenticalTo(pipes.For("123456789")))
+		Expect(pipes.For("bar")).NotTo(BeIdenticalTo(pipes.For("foo")))
+		Expect(pipes.pipes).To(HaveLen(2))
+
+		pipes.For("foo").Set("foo", "1", 0)
+		pipes.For("bar").Set("bar", "2", 0)
+		Expect(pipes.Exec()).To(Succeed())
+		Expect(client.MGet("foo", "bar").Val()).To(Equal([]interface{}{"1", "2"}))
+
+		// a single pipeline without a cluster
+		Expect(NewRedisStorage(client).pipelines().nodes).To(BeNil())
+	})
+
+})
@@ -0,0 +1,102 @@
+package cntdb
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+)
+
+// retentionRefresh is the interval at which stored retention policies
+// are reloaded
+const retentionRefresh = time.Minute
+
+type retention struct {
+	policies map[string]time.Duration
+	loaded   time.Time
+	mu       sync.Mutex
+}
+
+// TTL returns the retention for a metric. The policy with the longest
+// matching prefix wins.
+func (r *retention) TTL(metric string) time.Duration {
+	ttl, size := storageTTL, -1
+	for prefix, val := range r.policies {
+		if len(prefix) > size && strings.HasPrefix(metric, prefix) {
+			ttl, size = val, len(prefix)
+		}
+	}
+	return ttl
+}
+
+// MaxTTL returns the longest retention of any metric.
+func (r *retention) MaxTTL() time.Duration {
+	ttl := storageTTL
+	for _, val := range r.policies {
+		if val > ttl {
+			ttl = val
+		}
+	}
+	return ttl
+}
+
+// SetRetention stores a retention policy for all metrics starting with prefix.
+// The policy is shared by all processes using the same storage. An empty
+// prefix overrides the default. A zero ttl removes the policy.
+func (b *DB) SetRetention(prefix string, ttl time.Duration) error {
+	value := ""
+	if ttl > 0 {
+		value = ttl.String()
+	}
+	if err := b.store.WriteMeta("retention", prefix, value); err != nil {
+		return err
+	}
+
+	b.retention.mu.Lock()
+	b.retention.loaded = time.Time{}
+	b.retention.mu.Unlock()
+	return nil
+}
+
+// RetentionPolicies returns all stored retention policies by prefix.
+func (b *DB) RetentionPolicies(ctx context.Context) (map[string]time.Duration, error) {
+	fields, err := b.store.ReadMeta(ctx, "retention")
+	if err != nil {
+		return nil, err
+	}
+
+	policies := make(map[string]time.Duration, len(fields))
+	for prefix, str := range fields {
+		if ttl, err := time.ParseDuration(str); err == nil && ttl > 0 {
+			policies[prefix] = ttl
+		}
+	}
+	return policies, nil
+}
+
+// loads retention policies, unless recently loaded
+func (b *DB) loadRetention(ctx context.Context) (*retention, error) {
+	b.retention.mu.Lock()
+	defer b.retention.mu.Unlock()
+
+	if now := time.Now(); now.Sub(b.retention.loaded) > retentionRefresh {
+		policies, err := b.RetentionPolicies(ctx)
+		if err != nil {
+			return nil, err
+		}
+		b.retention.policies = policies
+		b.retention.loaded = now
+	}
+	return &retention{policies: b.retention.policies}, nil
+}
+
+// returns the remaining TTL of a series day, aligned to the end of the day
+func (b *DB) seriesTTL(r *retention, metric string, unixDay int64) time.Duration {
+	ttl := r.TTL(metric)
+	if tier, ok := b.rollups.tierOf(metric); ok {
+		ttl = tier.Retention
+	}
+
+	end := time.Unix((unixDay+1)*86400, 0)
+	return end.Add(ttl).Sub(b.now())
+}
@@ -0,0 +1,83 @@
+package cntdb
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-redis/redis"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("retention", func() {
+	var subject *DB
+	var client *redis.Client
+
+	BeforeEach(func() {
+		subject, client = openTestDB("2014-10-24T12:00:00Z")
+
+		Expect(subject.SetRetention("debug.", 7*24*time.Hour)).To(Succeed())
+		Expect(subject.SetRetention("debug.http", 2*24*time.Hour)).To(Succeed())
+		Expect(subject.SetRetention("billing", 400*24*time.Hour)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		closeTestDB(client)
+	})
+
+	It("should store policies", func() {
+		Expect(subject.RetentionPolicies(context.Background())).To(Equal(map[string]time.Duration{
+			"debug.":     7 * 24 * time.Hour,
+			"debug.http": 2 * 24 * time.Hour,
+			"billing":    400 * 24 * time.Hour,
+		}))
+		Expect(client.HGetAll("meta:retention").Val()).To(HaveKeyWithValue("billing", "9600h0m0s"))
+
+		Expect(subject.SetRetention("debug.", 0)).To(Succeed())
+		Expect(subject.RetentionPolicies(context.Background())).To(HaveLen(2))
+	})
+
+	It("should share policies", func() {
+		other := NewDBWithClient(client)
+		ret, err := other.loadRetention(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ret.TTL("cpu")).To(Equal(storageTTL))
+		Expect(ret.TTL("debug.cpu")).To(Equal(7 * 24 * time.Hour))
+		Expect(ret.TTL("debug.http.reqs")).To(Equal(2 * 24 * time.Hour))
+		Expect(ret.TTL("billing.eu")).To(Equal(400 * 24 * time.Hour))
+	})
+
+	It("should align expiry to the end of the day", func() {
+		Expect(subject.Increment([]Point{
+			point("cpu,a 1414141414 1"),        // 2014-10-24T09:03:34Z
+			point("debug.cpu,a 1414141414 1"),  // 2014-10-24T09:03:34Z
+			point("debug.cpu,a 1414200000 1"),  // 2014-10-25T01:20:00Z
+			point("billing,a 1414141414 1"),    // 2014-10-24T09:03:34Z
+			point("debug.http,a 1413800000 1"), // 2014-10-20T10:13:20Z
+		})).To(Succeed())
+
+		Expect(client.TTL("s:cpu,a:16367").Val()).To(BeNumerically("~", storageTTL+12*time.Hour, time.Second))
+		Expect(client.TTL("s:debug.cpu,a:16367").Val()).To(BeNumerically("~", 7*24*time.Hour+12*time.Hour, time.Second))
+		Expect(client.TTL("s:debug.cpu,a:16368").Val()).To(BeNumerically("~", 8*24*time.Hour+12*time.Hour, time.Second))
+		Expect(client.TTL("s:billing,a:16367").Val()).To(BeNumerically("~", 400*24*time.Hour+12*time.Hour, time.Second))
+		Expect(client.Exists("s:debug.http,a:16363").Val()).To(Equal(int64(0)))
+
+		subject.now = fixedClock("2014-10-24T18:00:00Z")
+		Expect(subject.Increment([]Point{point("cpu,a 1414141414 1")})).To(Succeed())
+		Expect(client.TTL("s:cpu,a:16367").Val()).To(BeNumerically("~", storageTTL+6*time.Hour, time.Second))
+	})
+
+	It("should compact by policy", func() {
+		Expect(subject.Increment([]Point{
+			point("cpu,a 1414141414 1"),
+			point("debug.cpu,a 1414141414 1"),
+			point("billing,a 1414141414 1"),
+		})).To(Succeed())
+
+		subject.now = fixedClock("2014-11-10T00:00:00Z")
+		Expect(subject.Compact(context.Background())).To(Succeed())
+		Expect(client.SMembers("td:a:16367").Val()).To(ConsistOf("s:cpu,a:16367", "s:billing,a:16367"))
+		Expect(client.Exists("md:debug.cpu:16367").Val()).To(Equal(int64(0)))
+	})
+
+})
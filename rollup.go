@@ -0,0 +1,526 @@
+package cntdb
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errInvalidTiers = errors.New("cntdb: invalid rollup tiers")
+
+// rollupRefresh is the interval at which stored rollup watermarks are
+// reloaded
+const rollupRefresh = time.Minute
+
+// Tier is a rollup tier.
+type Tier struct {
+	// Interval of the rolled-up buckets. Must be a multiple of a minute and
+	// of the interval of the previous tier.
+	Interval time.Duration
+	// Retention of the rolled-up data.
+	Retention time.Duration
+}
+
+// Metric returns the name of the metric which stores the rolled-up
+// data of the source metric.
+func (t Tier) Metric(metric string) string {
+	return metric + "@" + t.suffix()
+}
+
+func (t Tier) suffix() string {
+	return strconv.FormatInt(int64(t.Interval/time.Minute), 10) + "m"
+}
+
+// SetRollups configures rollup tiers, from finest to coarsest. Written data
+// is rolled-up into each tier by Rollup. Queries read from the coarsest tier
+// that fits the requested interval. SetRollups must be called before the DB
+// is used.
+//
+// The first call for a tier stores a watermark in the storage, which is
+// shared by all processes. Data written before may not have been tracked, so
+// queries read buckets before the watermark from raw data. Processes which
+// have not called SetRollups track their writes once they see a watermark.
+func (b *DB) SetRollups(tiers ...Tier) error {
+	prev := time.Minute
+	for _, tier := range tiers {
+		if tier.Interval <= prev || tier.Interval%prev != 0 || tier.Retention <= 0 {
+			return errInvalidTiers
+		}
+		prev = tier.Interval
+	}
+
+	b.rollups.tiers = tiers
+	b.rollups.mu.Lock()
+	b.rollups.loaded = time.Time{}
+	b.rollups.mu.Unlock()
+
+	stored, err := b.RollupWatermarks(context.Background())
+	if err != nil {
+		return err
+	}
+
+	// tier buckets are complete once all processes track writes to them
+	start := b.now().Add(rollupRefresh)
+	for _, tier := range tiers {
+		if _, ok := stored[tier.suffix()]; ok {
+			continue
+		}
+
+		since := start.Truncate(tier.Interval).Add(tier.Interval)
+		if err := b.store.WriteMeta("rollups", tier.suffix(), strconv.FormatInt(since.Unix(), 10)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RollupWatermarks returns the stored watermarks of all tiers, by tier
+// metric suffix, e.g. "60m". Tier buckets before the watermark are read
+// from raw data.
+func (b *DB) RollupWatermarks(ctx context.Context) (map[string]time.Time, error) {
+	fields, err := b.store.ReadMeta(ctx, "rollups")
+	if err != nil {
+		return nil, err
+	}
+
+	watermarks := make(map[string]time.Time, len(fields))
+	for suffix, str := range fields {
+		if sec, err := strconv.ParseInt(str, 10, 64); err == nil {
+			watermarks[suffix] = time.Unix(sec, 0)
+		}
+	}
+	return watermarks, nil
+}
+
+// loads rollup watermarks, unless recently loaded
+func (b *DB) loadWatermarks(ctx context.Context) (map[string]time.Time, error) {
+	b.rollups.mu.Lock()
+	defer b.rollups.mu.Unlock()
+
+	if now := time.Now(); now.Sub(b.rollups.loaded) > rollupRefresh {
+		watermarks, err := b.RollupWatermarks(ctx)
+		if err != nil {
+			return nil, err
+		}
+		b.rollups.watermarks = watermarks
+		b.rollups.loaded = now
+	}
+	return b.rollups.watermarks, nil
+}
+
+// Rollup updates all rollup tiers of buckets written to since their last
+// rollup. Written buckets are tracked in the storage, so buckets written by
+// other processes, or before a restart, are rolled up too. Until rolled up,
+// queries read these buckets from raw data.
+func (b *DB) Rollup(ctx context.Context) error {
+	if len(b.rollups.tiers) == 0 {
+		return nil
+	}
+
+	ret, err := b.loadRetention(ctx)
+	if err != nil {
+		return err
+	}
+
+	// markers of all metrics, as far back as points may be written
+	maxDay := b.now().Unix() / 86400
+	minDay := maxDay - int64(ret.MaxTTL()/(24*time.Hour)) - 1
+	keys, err := b.scanIndex(ctx, rollupIndex, minDay, maxDay)
+	if err != nil {
+		return err
+	}
+
+	dirty, err := b.dirtyBuckets(ctx, keys.Slice())
+	if err != nil {
+		return err
+	}
+	if len(dirty) == 0 {
+		return nil
+	}
+
+	buckets := make(map[rollupBucket]struct{}, len(dirty))
+	for bucket := range dirty {
+		buckets[bucket] = struct{}{}
+	}
+	if err := b.rollup(ctx, buckets); err != nil {
+		return err
+	}
+
+	// record the write counts which have been rolled up
+	batch := &Batch{Entries: make([]Entry, 0, len(dirty))}
+	for bucket, count := range dirty {
+		key, minute := bucket.marker(markerRolled)
+		ttl := b.seriesTTL(ret, bucket.metric, bucket.unixDay())
+		if ttl <= 0 {
+			continue
+		}
+		batch.Entries = append(batch.Entries, Entry{Key: key, Minute: minute, Value: count, TTL: ttl})
+	}
+	if len(batch.Entries) == 0 {
+		return nil
+	}
+	return b.store.Write(batch)
+}
+
+// RunRollups calls Rollup in the given interval until the context is
+// cancelled. Errors are passed to onError, which may be nil, and dirty
+// buckets are retried in the next interval.
+func (b *DB) RunRollups(ctx context.Context, interval time.Duration, onError func(error)) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			if err := b.Rollup(ctx); err != nil && onError != nil && ctx.Err() == nil {
+				onError(err)
+			}
+		}
+	}
+}
+
+func (b *DB) rollup(ctx context.Context, dirty map[rollupBucket]struct{}) error {
+	tiers := b.rollups.tiers
+	for i, tier := range tiers {
+		next := make(map[rollupBucket]struct{})
+		for _, r := range rollupRanges(dirty, tier.Interval) {
+			source := r.metric
+			if i > 0 {
+				source = tiers[i-1].Metric(r.metric)
+			}
+
+			points, err := b.queryPoints(ctx, &Criteria{
+				Metric:   source,
+				From:     r.from,
+				Until:    r.until.Add(tier.Interval - time.Minute),
+				Interval: tier.Interval,
+			}, false)
+			if err != nil {
+				return err
+			}
+
+			for n := range points {
+				points[n].metric = tier.Metric(r.metric)
+			}
+			if err := b.Set(points); err != nil {
+				return err
+			}
+
+			if i+1 < len(tiers) {
+				for ts := r.from; !ts.After(r.until); ts = ts.Add(tier.Interval) {
+					next[rollupBucket{metric: r.metric, start: ts.Truncate(tiers[i+1].Interval).Unix()}] = struct{}{}
+				}
+			}
+		}
+		dirty = next
+	}
+	return nil
+}
+
+// --------------------------------------------------------------------
+
+type segment struct {
+	metric      string
+	from, until timestamp
+}
+
+type rollupBucket struct {
+	metric string
+	start  int64 // unix seconds
+}
+
+type rollupRange struct {
+	metric      string
+	from, until time.Time // first and last bucket
+}
+
+// groups buckets into contiguous ranges
+func rollupRanges(buckets map[rollupBucket]struct{}, interval time.Duration) []rollupRange {
+	starts := make(map[string][]int64)
+	for bucket := range buckets {
+		starts[bucket.metric] = append(starts[bucket.metric], bucket.start)
+	}
+
+	step := int64(interval / time.Second)
+	ranges := make([]rollupRange, 0, len(starts))
+	for metric, list := range starts {
+		sort.Sort(int64Slice(list))
+		for i, start := range list {
+			if i != 0 && start == list[i-1]+step {
+				ranges[len(ranges)-1].until = time.Unix(start, 0)
+				continue
+			}
+			ranges = append(ranges, rollupRange{metric: metric, from: time.Unix(start, 0), until: time.Unix(start, 0)})
+		}
+	}
+	return ranges
+}
+
+type rollups struct {
+	tiers      []Tier
+	watermarks map[string]time.Time // by tier suffix, see loadWatermarks
+	loaded     time.Time
+	mu         sync.Mutex
+}
+
+// tierOf returns the tier of a rolled-up metric
+func (r *rollups) tierOf(metric string) (Tier, bool) {
+	if piv := strings.LastIndexByte(metric, '@'); piv > -1 {
+		for _, tier := range r.tiers {
+			if metric[piv+1:] == tier.suffix() {
+				return tier, true
+			}
+		}
+	}
+	return Tier{}, false
+}
+
+// --------------------------------------------------------------------
+
+// Written first tier buckets are tracked by marker series in the storage.
+// For each bucket, <metric>@written counts writes and <metric>@rolled holds
+// the count which was last rolled up. A bucket is dirty while its written
+// count is ahead. Counts are only ever incremented by writers and set to
+// observed counts by rollups, so concurrent processes cannot lose writes.
+const (
+	markerWritten = "written"
+	markerRolled  = "rolled"
+)
+
+// index set of all written markers
+const rollupIndex = "m:@rollup"
+
+// marker returns the key and minute of a marker of the bucket
+func (b rollupBucket) marker(kind string) (string, int) {
+	pt := Point{metric: b.metric + "@" + kind, timestamp: timestamp{time.Unix(b.start, 0)}}
+	return pt.keyName(), int(pt.timestamp.MinuteOfDay())
+}
+
+func (b rollupBucket) unixDay() int64 {
+	return timestamp{time.Unix(b.start, 0)}.UnixDay()
+}
+
+// markWritten counts writes to the first tier buckets of points. It must be
+// called after the points were written. Without local tiers, the finest
+// tier with a stored watermark is used.
+func (b *DB) markWritten(ret *retention, points []Point) error {
+	watermarks, err := b.loadWatermarks(context.Background())
+	if err != nil {
+		return err
+	}
+
+	var interval time.Duration
+	if len(b.rollups.tiers) != 0 {
+		interval = b.rollups.tiers[0].Interval
+	} else {
+		for suffix := range watermarks {
+			if d, ok := suffixInterval(suffix); ok && (interval == 0 || d < interval) {
+				interval = d
+			}
+		}
+	}
+	if interval == 0 {
+		return nil
+	}
+
+	buckets := make(map[rollupBucket]struct{})
+	for _, pt := range points {
+		// skip rolled-up metrics
+		if piv := strings.LastIndexByte(pt.metric, '@'); piv > -1 {
+			if _, ok := watermarks[pt.metric[piv+1:]]; ok {
+				continue
+			}
+		}
+		buckets[rollupBucket{metric: pt.metric, start: pt.timestamp.Truncate(interval).Unix()}] = struct{}{}
+	}
+
+	batch := &Batch{Incr: true, Entries: make([]Entry, 0, len(buckets))}
+	for bucket := range buckets {
+		ttl := b.seriesTTL(ret, bucket.metric, bucket.unixDay())
+		if ttl <= 0 {
+			continue
+		}
+
+		key, minute := bucket.marker(markerWritten)
+		batch.Entries = append(batch.Entries, Entry{Key: key, Minute: minute, Value: 1, Index: []string{rollupIndex}, TTL: ttl})
+	}
+	if len(batch.Entries) == 0 {
+		return nil
+	}
+	return b.store.Write(batch)
+}
+
+// dirtyBuckets reads written markers and returns dirty buckets with their
+// write counts
+func (b *DB) dirtyBuckets(ctx context.Context, keys []string) (map[rollupBucket]int64, error) {
+	ranges := make([]SeriesRange, 0, 2*len(keys))
+	for _, key := range keys {
+		ser, err := parseSeries(key)
+		if err != nil {
+			return nil, err
+		}
+
+		metric := strings.TrimSuffix(ser.metric, "@"+markerWritten)
+		rolled := Point{metric: metric + "@" + markerRolled, timestamp: timestamp{ser.StartTime()}}
+		ranges = append(ranges, FullDay(key), FullDay(rolled.keyName()))
+	}
+
+	written := make(map[rollupBucket]int64)
+	rolled := make(map[rollupBucket]int64)
+	if err := b.store.ReadSeries(ctx, ranges, func(key string, minute int, value int64) error {
+		ser, err := parseSeries(key)
+		if err != nil {
+			return err
+		}
+
+		start := ser.StartTime().Add(time.Duration(minute) * time.Minute).Unix()
+		if metric := strings.TrimSuffix(ser.metric, "@"+markerWritten); metric != ser.metric {
+			written[rollupBucket{metric: metric, start: start}] = value
+		} else {
+			rolled[rollupBucket{metric: strings.TrimSuffix(ser.metric, "@"+markerRolled), start: start}] = value
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	for bucket, count := range written {
+		if count <= rolled[bucket] {
+			delete(written, bucket)
+		}
+	}
+	return written, nil
+}
+
+// removes all markers of a metric
+func (b *DB) dropMarkers(ctx context.Context, metric string) error {
+	keys, err := b.scanIndex(ctx, rollupIndex, minTimestamp.UnixDay(), maxTimestamp.UnixDay())
+	if err != nil {
+		return err
+	}
+
+	var removals []Removal
+	for _, key := range keys.Slice() {
+		ser, err := parseSeries(key)
+		if err != nil {
+			return err
+		}
+		if ser.metric != metric+"@"+markerWritten {
+			continue
+		}
+
+		rolled := Point{metric: metric + "@" + markerRolled, timestamp: timestamp{ser.StartTime()}}
+		removals = append(removals,
+			Removal{Key: key, Index: []string{rollupIndex}},
+			Removal{Key: rolled.keyName()},
+		)
+	}
+	if len(removals) == 0 {
+		return nil
+	}
+	return b.store.Remove(ctx, removals)
+}
+
+// returns the start of the earliest dirty bucket of a metric between from
+// and until
+func (b *DB) dirtyFrom(ctx context.Context, metric string, from, until time.Time) (time.Time, bool, error) {
+	interval := b.rollups.tiers[0].Interval
+	from = from.Truncate(interval)
+
+	minDay, maxDay := timestamp{from}.UnixDay(), timestamp{until}.UnixDay()
+	keys := make([]string, 0, maxDay-minDay+1)
+	for day := minDay; day <= maxDay; day++ {
+		keys = append(keys, Point{metric: metric + "@" + markerWritten, timestamp: timestamp{time.Unix(day*86400, 0)}}.keyName())
+	}
+
+	dirty, err := b.dirtyBuckets(ctx, keys)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+
+	var earliest int64
+	found := false
+	for bucket := range dirty {
+		if bucket.start >= from.Unix() && !time.Unix(bucket.start, 0).After(until) && (!found || bucket.start < earliest) {
+			earliest, found = bucket.start, true
+		}
+	}
+	return time.Unix(earliest, 0), found, nil
+}
+
+// segments splits a query into segments. Where buckets of the query interval
+// are fully covered by completed tier buckets, the coarsest matching tier is
+// used, the remaining edges are read from finer tiers or the raw metric.
+// Tier buckets are complete if they start at or after the watermark of their
+// tier and end before now, callers pass the start of the earliest dirty
+// bucket if that is before now.
+func (r *rollups) segments(metric string, bkt bucketing, from, until timestamp, now time.Time, watermarks map[string]time.Time) []segment {
+	if _, ok := r.tierOf(metric); ok || len(r.tiers) == 0 {
+		return []segment{{metric: metric, from: from, until: until}}
+	}
+	return r.split(r.tiers, metric, bkt, from, until, now, watermarks)
+}
+
+func (r *rollups) split(tiers []Tier, metric string, bkt bucketing, from, until timestamp, now time.Time, watermarks map[string]time.Time) []segment {
+	f, u := from.Truncate(time.Minute), until.Truncate(time.Minute)
+
+	for i := len(tiers) - 1; i >= 0; i-- {
+		tier := tiers[i]
+		if !bkt.Aligned(tier.Interval, f, u) {
+			continue
+		}
+
+		since, ok := watermarks[tier.suffix()]
+		if !ok {
+			continue
+		}
+
+		// first and (exclusive) last tier bucket
+		a := f.Truncate(tier.Interval)
+		if a.Before(f) {
+			a = a.Add(tier.Interval)
+		}
+		if a.Before(since) {
+			a = since
+		}
+		z := u.Add(time.Minute).Truncate(tier.Interval)
+		if cur := now.Truncate(tier.Interval); cur.Before(z) {
+			z = cur
+		}
+		if !a.Before(z) {
+			continue
+		}
+
+		var segs []segment
+		if f.Before(a) {
+			segs = append(segs, r.split(tiers[:i], metric, bkt, from, timestamp{a.Add(-time.Minute)}, now, watermarks)...)
+		}
+		segs = append(segs, segment{metric: tier.Metric(metric), from: timestamp{a}, until: timestamp{z.Add(-time.Minute)}})
+		if !u.Before(z) {
+			segs = append(segs, r.split(tiers[:i], metric, bkt, timestamp{z}, until, now, watermarks)...)
+		}
+		return segs
+	}
+	return []segment{{metric: metric, from: from, until: until}}
+}
+
+// parses the interval of a tier suffix
+func suffixInterval(suffix string) (time.Duration, bool) {
+	mins, err := strconv.ParseInt(strings.TrimSuffix(suffix, "m"), 10, 64)
+	if err != nil || mins <= 0 || !strings.HasSuffix(suffix, "m") {
+		return 0, false
+	}
+	return time.Duration(mins) * time.Minute, true
+}
+
+type int64Slice []int64
+
+func (p int64Slice) Len() int           { return len(p) }
+func (p int64Slice) Less(i, j int) bool { return p[i] < p[j] }
+func (p int64Slice) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
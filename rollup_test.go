@@ -0,0 +1,230 @@
+package cntdb
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-redis/redis"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("rollups", func() {
+	var subject *DB
+	var client *redis.Client
+
+	hourly := Tier{Interval: time.Hour, Retention: 100 * 24 * time.Hour}
+	daily := Tier{Interval: 24 * time.Hour, Retention: 400 * 24 * time.Hour}
+
+	query := func(c *Criteria) ResultSet {
+		res, err := subject.Query(context.Background(), c)
+		Expect(err).NotTo(HaveOccurred())
+		return res
+	}
+
+	BeforeEach(func() {
+		subject, client = openTestDB("2014-10-20T12:00:00Z")
+		Expect(subject.SetRollups(hourly, daily)).To(Succeed())
+		subject.now = fixedClock("2014-10-26T12:00:00Z")
+
+		Expect(subject.Increment(append(cpuPoints(),
+			point("cpu,b,c 1414317600 64"), // 2014-10-26T10:00:00Z
+		))).To(Succeed())
+	})
+
+	AfterEach(func() {
+		closeTestDB(client)
+	})
+
+	It("should validate tiers", func() {
+		Expect(subject.SetRollups(Tier{Interval: 30 * time.Second, Retention: time.Hour})).To(Equal(errInvalidTiers))
+		Expect(subject.SetRollups(hourly, Tier{Interval: 90 * time.Minute, Retention: time.Hour})).To(Equal(errInvalidTiers))
+		Expect(subject.SetRollups(daily, hourly)).To(Equal(errInvalidTiers))
+		Expect(subject.SetRollups(Tier{Interval: time.Hour})).To(Equal(errInvalidTiers))
+	})
+
+	It("should roll up", func() {
+		Expect(subject.Rollup(context.Background())).To(Succeed())
+		Expect(client.Keys("s:cpu@[0-9]*").Val()).To(ConsistOf([]string{
+			"s:cpu@60m,a,b:16367",
+			"s:cpu@60m,a,c:16367",
+			"s:cpu@60m,b,c:16367",
+			"s:cpu@60m,a,b:16368",
+			"s:cpu@60m,b,c:16368",
+			"s:cpu@60m,b,c:16369",
+			"s:cpu@1440m,a,b:16367",
+			"s:cpu@1440m,a,c:16367",
+			"s:cpu@1440m,b,c:16367",
+			"s:cpu@1440m,a,b:16368",
+			"s:cpu@1440m,b,c:16368",
+			"s:cpu@1440m,b,c:16369",
+		}))
+		Expect(client.HGetAll("s:cpu@60m,a,c:16367").Val()).To(Equal(map[string]string{"0540": "6"}))
+		Expect(client.HGetAll("s:cpu@1440m,b,c:16368").Val()).To(Equal(map[string]string{"0000": "32"}))
+		Expect(client.TTL("s:cpu@1440m,b,c:16368").Val()).To(BeNumerically("~", daily.Retention-12*time.Hour, time.Second))
+
+		// idempotent, no drift
+		Expect(client.HSet("s:cpu@written:16367", "0540", 2).Err()).NotTo(HaveOccurred())
+		Expect(subject.Rollup(context.Background())).To(Succeed())
+		Expect(client.HGetAll("s:cpu@60m,a,c:16367").Val()).To(Equal(map[string]string{"0540": "6"}))
+		Expect(client.HGetAll("s:cpu@1440m,a,c:16367").Val()).To(Equal(map[string]string{"0000": "6"}))
+		Expect(client.HGet("s:cpu@rolled:16367", "0540").Val()).To(Equal("2"))
+	})
+
+	It("should store watermarks", func() {
+		Expect(subject.RollupWatermarks(context.Background())).To(Equal(map[string]time.Time{
+			"60m":   xmltime("2014-10-20T13:00:00Z"),
+			"1440m": xmltime("2014-10-21T00:00:00Z"),
+		}))
+
+		// existing watermarks are kept
+		Expect(subject.SetRollups(hourly, daily)).To(Succeed())
+		Expect(client.HGetAll("meta:rollups").Val()).To(Equal(map[string]string{
+			"60m":   "1413810000",
+			"1440m": "1413849600",
+		}))
+	})
+
+	It("should read raw data before watermarks", func() {
+		closeTestDB(client)
+		subject, client = openTestDB("2014-10-26T12:00:00Z")
+		Expect(subject.Increment(cpuPoints())).To(Succeed())
+		Expect(subject.SetRollups(hourly, daily)).To(Succeed())
+		Expect(subject.Rollup(context.Background())).To(Succeed())
+
+		Expect(query(&Criteria{Metric: "cpu", From: xmltime("2014-10-24T00:00:00Z"), Until: xmltime("2014-10-25T23:59:00Z"), Interval: 24 * time.Hour})).To(Equal(ResultSet{
+			{xmltime("2014-10-24T00:00:00Z"), 15, xmltime("2014-10-25T00:00:00Z")},
+			{xmltime("2014-10-25T00:00:00Z"), 48, xmltime("2014-10-26T00:00:00Z")},
+		}))
+	})
+
+	It("should track writes of processes without tiers", func() {
+		other := NewDBWithClient(client)
+		other.now = subject.now
+		Expect(other.Increment([]Point{point("cpu,a,c 1414141300 2")})).To(Succeed())
+		Expect(client.HGetAll("s:cpu@written:16367").Val()).To(HaveKeyWithValue("0540", "2"))
+	})
+
+	It("should roll up buckets written by other processes", func() {
+		Expect(subject.Rollup(context.Background())).To(Succeed())
+
+		other := NewDBWithClient(client)
+		other.now = subject.now
+		Expect(other.SetRollups(hourly, daily)).To(Succeed())
+		Expect(other.Increment([]Point{point("cpu,a,c 1414141300 2")})).To(Succeed())
+
+		// dirty buckets are read from raw data
+		crit := &Criteria{Metric: "cpu", From: xmltime("2014-10-24T00:00:00Z"), Until: xmltime("2014-10-25T23:59:00Z"), Interval: 24 * time.Hour}
+		expected := ResultSet{
+			{xmltime("2014-10-24T00:00:00Z"), 17, xmltime("2014-10-25T00:00:00Z")},
+			{xmltime("2014-10-25T00:00:00Z"), 48, xmltime("2014-10-26T00:00:00Z")},
+		}
+		Expect(query(crit)).To(Equal(expected))
+		Expect(client.HGetAll("s:cpu@1440m,a,c:16367").Val()).To(Equal(map[string]string{"0000": "6"}))
+
+		Expect(subject.Rollup(context.Background())).To(Succeed())
+		Expect(client.HGetAll("s:cpu@60m,a,c:16367").Val()).To(Equal(map[string]string{"0540": "8"}))
+		Expect(client.HGetAll("s:cpu@1440m,a,c:16367").Val()).To(Equal(map[string]string{"0000": "8"}))
+		Expect(query(crit)).To(Equal(expected))
+	})
+
+	It("should read from tiers", func() {
+		crit := &Criteria{Metric: "cpu", From: xmltime("2014-10-24T00:00:00Z"), Until: xmltime("2014-10-27T00:00:00Z"), Interval: 24 * time.Hour}
+		expected := ResultSet{
+			{xmltime("2014-10-24T00:00:00Z"), 15, xmltime("2014-10-25T00:00:00Z")},
+			{xmltime("2014-10-25T00:00:00Z"), 48, xmltime("2014-10-26T00:00:00Z")},
+			{xmltime("2014-10-26T00:00:00Z"), 64, xmltime("2014-10-27T00:00:00Z")},
+		}
+		Expect(query(crit)).To(Equal(expected))
+		Expect(subject.Rollup(context.Background())).To(Succeed())
+		Expect(query(crit)).To(Equal(expected))
+
+		// remove raw data from complete days
+		Expect(client.Del("s:cpu,a,b:16367", "s:cpu,a,c:16367", "s:cpu,b,c:16367", "s:cpu,a,b:16368", "s:cpu,b,c:16368").Err()).NotTo(HaveOccurred())
+		Expect(query(crit)).To(Equal(expected))
+
+		// edges are read from hourly tier
+		Expect(query(&Criteria{Metric: "cpu", From: xmltime("2014-10-24T10:00:00Z"), Until: xmltime("2014-10-25T05:00:00Z"), Interval: time.Hour})).To(Equal(ResultSet{
+			{xmltime("2014-10-24T10:00:00Z"), 8, xmltime("2014-10-24T11:00:00Z")},
+			{xmltime("2014-10-25T01:00:00Z"), 16, xmltime("2014-10-25T02:00:00Z")},
+		}))
+		// unaligned edges are read from raw data
+		Expect(query(&Criteria{Metric: "cpu", From: xmltime("2014-10-24T09:30:00Z"), Until: xmltime("2014-10-25T05:00:00Z"), Interval: time.Hour})).To(Equal(ResultSet{
+			{xmltime("2014-10-24T10:00:00Z"), 8, xmltime("2014-10-24T11:00:00Z")},
+			{xmltime("2014-10-25T01:00:00Z"), 16, xmltime("2014-10-25T02:00:00Z")},
+		}))
+	})
+
+	It("should run rollups", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error, 1)
+		go func() { done <- subject.RunRollups(ctx, 10*time.Millisecond, nil) }()
+
+		Eventually(func() []string { return client.Keys("s:cpu@1440m,*").Val() }).Should(HaveLen(6))
+		cancel()
+		Eventually(done).Should(Receive(Equal(context.Canceled)))
+	})
+
+	It("should keep running rollups on errors", func() {
+		failing := NewDBWithOptions(&redis.Options{Addr: "127.0.0.1:1"})
+		defer failing.Close()
+		failing.rollups.tiers = []Tier{hourly, daily}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		errs := make(chan error, 10)
+		done := make(chan error, 1)
+		go func() {
+			done <- failing.RunRollups(ctx, 10*time.Millisecond, func(err error) {
+				select {
+				case errs <- err:
+				default:
+				}
+			})
+		}()
+
+		Eventually(func() int { return len(errs) }).Should(BeNumerically(">=", 2))
+		cancel()
+		Eventually(done).Should(Receive(Equal(context.Canceled)))
+	})
+
+	It("should split queries into segments", func() {
+		Expect(subject.Rollup(context.Background())).To(Succeed())
+		tiers := &subject.rollups
+		now := xmltime("2014-10-26T12:30:00Z")
+		watermarks := map[string]time.Time{
+			"60m":   xmltime("2014-10-20T13:00:00Z"),
+			"1440m": xmltime("2014-10-21T00:00:00Z"),
+		}
+		seg := func(metric, from, until string) segment {
+			return segment{metric: metric, from: timestamp{xmltime(from)}, until: timestamp{xmltime(until)}}
+		}
+
+		Expect(tiers.segments("cpu", bucketing{interval: time.Minute}, timestamp{xmltime("2014-10-24T09:30:00Z")}, timestamp{xmltime("2014-10-25T05:00:00Z")}, now, watermarks)).To(Equal([]segment{
+			seg("cpu", "2014-10-24T09:30:00Z", "2014-10-25T05:00:00Z"),
+		}))
+		Expect(tiers.segments("cpu", bucketing{interval: time.Hour}, timestamp{xmltime("2014-10-24T09:30:00Z")}, timestamp{xmltime("2014-10-25T05:00:00Z")}, now, watermarks)).To(Equal([]segment{
+			seg("cpu", "2014-10-24T09:30:00Z", "2014-10-24T09:59:00Z"),
+			seg("cpu@60m", "2014-10-24T10:00:00Z", "2014-10-25T04:59:00Z"),
+			seg("cpu", "2014-10-25T05:00:00Z", "2014-10-25T05:00:00Z"),
+		}))
+		Expect(tiers.segments("cpu", bucketing{interval: 24 * time.Hour}, timestamp{xmltime("2014-10-23T23:00:00Z")}, timestamp{xmltime("2014-10-26T12:30:00Z")}, now, watermarks)).To(Equal([]segment{
+			seg("cpu@60m", "2014-10-23T23:00:00Z", "2014-10-23T23:59:00Z"),
+			seg("cpu@1440m", "2014-10-24T00:00:00Z", "2014-10-25T23:59:00Z"),
+			seg("cpu@60m", "2014-10-26T00:00:00Z", "2014-10-26T11:59:00Z"),
+			seg("cpu", "2014-10-26T12:00:00Z", "2014-10-26T12:30:00Z"),
+		}))
+		// tiers are read from their watermarks
+		Expect(tiers.segments("cpu", bucketing{interval: 24 * time.Hour}, timestamp{xmltime("2014-10-24T00:00:00Z")}, timestamp{xmltime("2014-10-25T23:59:00Z")}, now, map[string]time.Time{
+			"60m":   xmltime("2014-10-24T10:00:00Z"),
+			"1440m": xmltime("2014-10-25T00:00:00Z"),
+		})).To(Equal([]segment{
+			seg("cpu", "2014-10-24T00:00:00Z", "2014-10-24T09:59:00Z"),
+			seg("cpu@60m", "2014-10-24T10:00:00Z", "2014-10-24T23:59:00Z"),
+			seg("cpu@1440m", "2014-10-25T00:00:00Z", "2014-10-25T23:59:00Z"),
+		}))
+		Expect(tiers.segments("cpu@60m", bucketing{interval: 24 * time.Hour}, timestamp{xmltime("2014-10-24T00:00:00Z")}, timestamp{xmltime("2014-10-26T00:00:00Z")}, now, watermarks)).To(Equal([]segment{
+			seg("cpu@60m", "2014-10-24T00:00:00Z", "2014-10-26T00:00:00Z"),
+		}))
+	})
+
+})
@@ -0,0 +1,157 @@
+package cntdb
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Scan performs a query and returns an iterator over the resulting points.
+// Unlike QueryPoints, series are read in batches, so memory use does not
+// grow with the number of matching series. Points of a batch are ordered by
+// series and time.
+func (b *DB) Scan(ctx context.Context, c *Criteria) *PointIterator {
+	return b.scanPoints(ctx, c, true)
+}
+
+func (b *DB) scanPoints(ctx context.Context, c *Criteria, tiers bool) *PointIterator {
+	segments, err := b.querySegments(ctx, c, tiers)
+	if err != nil {
+		return &PointIterator{err: err}
+	}
+
+	// buckets spanning multiple segments would be returned more than once,
+	// read raw data instead
+	bkt := c.getBucketing()
+	for _, seg := range segments[1:] {
+		if !bkt.Start(seg.from.Time).Equal(seg.from.Time) {
+			segments, _ = b.querySegments(ctx, c, false)
+			break
+		}
+	}
+
+	return &PointIterator{ctx: ctx, db: b, crit: c, segments: segments}
+}
+
+// PointIterator iterates over the points of a query.
+type PointIterator struct {
+	ctx  context.Context
+	db   *DB
+	crit *Criteria
+
+	segments []segment  // pending segments
+	seg      segment    // current segment
+	batches  [][]string // pending key batches of the current segment
+	points   []Point    // pending points of the current batch
+	point    Point      // current point
+	err      error
+}
+
+// Next advances the iterator to the next point. It returns false when all
+// points have been read or an error occurred.
+func (it *PointIterator) Next() bool {
+	for len(it.points) == 0 {
+		if it.err != nil || (len(it.batches) == 0 && len(it.segments) == 0) {
+			return false
+		}
+		it.err = it.fetch()
+	}
+
+	it.point, it.points = it.points[0], it.points[1:]
+	return true
+}
+
+// Point returns the current point.
+func (it *PointIterator) Point() Point {
+	return it.point
+}
+
+// Err returns the first error encountered during iteration.
+func (it *PointIterator) Err() error {
+	return it.err
+}
+
+// scopes the next segment or reads the next batch of series
+func (it *PointIterator) fetch() error {
+	if err := it.ctx.Err(); err != nil {
+		return err
+	}
+
+	if len(it.batches) == 0 {
+		it.seg, it.segments = it.segments[0], it.segments[1:]
+
+		keys, err := it.db.scopeKeys(it.ctx, it.seg.metric, it.crit.getFilter(), it.seg.from, it.seg.until)
+		if err != nil {
+			return err
+		}
+		it.batches = batchKeys(keys.Slice(), scanBatchSize)
+		return nil
+	}
+
+	batch := it.batches[0]
+	it.batches = it.batches[1:]
+
+	bkt := it.crit.getBucketing()
+	index := make(map[string]int)
+	points := make([]Point, 0, len(batch))
+	if err := it.db.scanSeries(it.ctx, batch, it.seg.from, it.seg.until, func(s series, ts time.Time, val int64) error {
+		point, err := NewPointAt(it.crit.Metric, s.tags, bkt.Start(ts).Local(), val)
+		if err != nil {
+			return err
+		}
+
+		pointID := point.uID()
+		if n, ok := index[pointID]; ok {
+			points[n].count += val
+			return nil
+		}
+		index[pointID] = len(points)
+		points = append(points, point)
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	sort.Slice(points, func(i, j int) bool {
+		if si, sj := points[i].Series(), points[j].Series(); si != sj {
+			return si < sj
+		}
+		return points[i].timestamp.Before(points[j].timestamp.Time)
+	})
+	it.points = points
+	return nil
+}
+
+// groups series keys into batches of about size keys, all days of a
+// series are kept in the same batch
+func batchKeys(keys []string, size int) [][]string {
+	index := make(map[string][]string)
+	for _, key := range keys {
+		name := key
+		if piv := strings.LastIndexByte(key, ':'); piv > 0 {
+			name = key[:piv]
+		}
+		index[name] = append(index[name], key)
+	}
+
+	names := make([]string, 0, len(index))
+	for name := range index {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var batches [][]string
+	var batch []string
+	for _, name := range names {
+		batch = append(batch, index[name]...)
+		if len(batch) >= size {
+			batches = append(batches, batch)
+			batch = nil
+		}
+	}
+	if len(batch) != 0 {
+		batches = append(batches, batch)
+	}
+	return batches
+}
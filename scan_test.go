@@ -0,0 +1,98 @@
+package cntdb
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-redis/redis"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Scan", func() {
+	var subject *DB
+	var client *redis.Client
+
+	scan := func(ctx context.Context, c *Criteria) ([]Point, error) {
+		iter := subject.Scan(ctx, c)
+
+		var points []Point
+		for iter.Next() {
+			points = append(points, iter.Point())
+		}
+		return points, iter.Err()
+	}
+
+	BeforeEach(func() {
+		subject, client = openTestDB("2014-10-26T00:00:00Z")
+
+		Expect(subject.Set(append(cpuPoints(), point("mem,a,c 1414141200 64")))).To(Succeed())
+	})
+
+	AfterEach(func() {
+		scanBatchSize = 500
+		closeTestDB(client)
+	})
+
+	It("should scan points", func() {
+		Expect(scan(context.Background(), &Criteria{
+			Metric:   "cpu",
+			From:     xmltime("2014-10-24T09:00:00Z"),
+			Interval: time.Hour,
+		})).To(Equal([]Point{
+			point("cpu,a,b 1414141200 1"),
+			point("cpu,a,b 1414198800 16"),
+			point("cpu,a,c 1414141200 6"),
+			point("cpu,b,c 1414144800 8"),
+			point("cpu,b,c 1414227600 32"),
+		}))
+	})
+
+	It("should scan in batches", func() {
+		scanBatchSize = 1
+
+		Expect(scan(context.Background(), &Criteria{
+			Metric:   "cpu",
+			Tags:     []string{"b"},
+			From:     xmltime("2014-10-24T00:00:00Z"),
+			Interval: 7 * 24 * time.Hour,
+		})).To(Equal([]Point{
+			point("cpu,a,b 1413763200 17"), // 2014-10-20T00:00:00Z
+			point("cpu,b,c 1413763200 40"), // 2014-10-20T00:00:00Z
+		}))
+	})
+
+	It("should scan with offsets", func() {
+		Expect(scan(context.Background(), &Criteria{
+			Metric:   "cpu",
+			Tags:     []string{"a"},
+			From:     xmltime("2014-10-24T08:30:00Z"),
+			Until:    xmltime("2014-10-24T23:59:00Z"),
+			Interval: time.Hour,
+			Offset:   30 * time.Minute,
+		})).To(Equal([]Point{
+			point("cpu,a,b 1414139400 1"), // 2014-10-24T08:30:00Z
+			point("cpu,a,c 1414139400 6"), // 2014-10-24T08:30:00Z
+		}))
+	})
+
+	It("should stop on cancelled contexts", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		points, err := scan(ctx, &Criteria{Metric: "cpu", From: xmltime("2014-10-24T09:00:00Z")})
+		Expect(err).To(Equal(context.Canceled))
+		Expect(points).To(BeEmpty())
+	})
+
+	It("should batch keys", func() {
+		keys := []string{"s:b:2", "s:a,x:1", "s:b:1", "s:a:2", "s:a:1", "s:c:1"}
+		Expect(batchKeys(keys, 2)).To(Equal([][]string{
+			{"s:a:2", "s:a:1"},
+			{"s:a,x:1", "s:b:2", "s:b:1"},
+			{"s:c:1"},
+		}))
+		Expect(batchKeys(nil, 2)).To(BeEmpty())
+	})
+
+})
@@ -0,0 +1,404 @@
+package cntdb
+
+import (
+	"context"
+	"hash/crc32"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/go-redis/redis"
+)
+
+// NewShardedDB connects to multiple redis servers and returns a new DB which
+// spreads series over all of them. Servers are identified by name.
+func NewShardedDB(shards map[string]*redis.Options) *DB {
+	stores := make(map[string]*RedisStorage, len(shards))
+	for name, opt := range shards {
+		store := NewRedisStorage(redis.NewClient(opt))
+		store.owned = true
+		stores[name] = store
+	}
+	return New(NewShardedStorage(stores))
+}
+
+// ShardedStorage spreads series over multiple Redis storages by consistent
+// hashing of the series name. Each shard maintains the index sets for the
+// series it holds, index scans are fanned out to all shards.
+type ShardedStorage struct {
+	shards map[string]*RedisStorage
+	ring   *hashRing
+}
+
+// NewShardedStorage creates a new storage from named shards. Names
+// determine the placement of series and must remain stable.
+func NewShardedStorage(shards map[string]*RedisStorage) *ShardedStorage {
+	names := make([]string, 0, len(shards))
+	for name := range shards {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return &ShardedStorage{shards: shards, ring: newHashRing(names)}
+}
+
+// Write implements Storage.
+func (s *ShardedStorage) Write(batch *Batch) error {
+	batches := make(map[string]*Batch, len(s.shards))
+	for _, ent := range batch.Entries {
+		name := s.ring.Get(seriesName(ent.Key))
+		sub, ok := batches[name]
+		if !ok {
+			sub = &Batch{Incr: batch.Incr}
+			batches[name] = sub
+		}
+		sub.Entries = append(sub.Entries, ent)
+	}
+
+	return s.each(func(name string, shard *RedisStorage) error {
+		if sub, ok := batches[name]; ok {
+			return shard.Write(sub)
+		}
+		return nil
+	})
+}
+
+// ReadMeta implements Storage. Meta records are read from all shards and
+// merged, so that shards added later do not hide existing fields. Fields
+// stored with different values are taken from the shard whose name sorts
+// first.
+func (s *ShardedStorage) ReadMeta(ctx context.Context, name string) (map[string]string, error) {
+	var mu sync.Mutex
+	records := make(map[string]map[string]string, len(s.shards))
+	if err := s.each(func(shardName string, shard *RedisStorage) error {
+		fields, err := shard.ReadMeta(ctx, name)
+		if err != nil {
+			return err
+		}
+
+		mu.Lock()
+		records[shardName] = fields
+		mu.Unlock()
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(records))
+	for shardName := range records {
+		names = append(names, shardName)
+	}
+	sort.Strings(names)
+
+	merged := make(map[string]string)
+	for _, shardName := range names {
+		for field, value := range records[shardName] {
+			if _, ok := merged[field]; !ok {
+				merged[field] = value
+			}
+		}
+	}
+	return merged, nil
+}
+
+// WriteMeta implements Storage. Meta records are written to all shards.
+func (s *ShardedStorage) WriteMeta(name, field, value string) error {
+	return s.each(func(_ string, shard *RedisStorage) error {
+		return shard.WriteMeta(name, field, value)
+	})
+}
+
+// ScanIndex implements Storage.
+func (s *ShardedStorage) ScanIndex(ctx context.Context, index string, minDay, maxDay int64, fn func(string) error) error {
+	var mu sync.Mutex
+	return s.each(func(_ string, shard *RedisStorage) error {
+		return shard.ScanIndex(ctx, index, minDay, maxDay, func(key string) error {
+			mu.Lock()
+			defer mu.Unlock()
+			return fn(key)
+		})
+	})
+}
+
+// ReadSeries implements Storage.
+func (s *ShardedStorage) ReadSeries(ctx context.Context, ranges []SeriesRange, fn func(string, int, int64) error) error {
+	groups := make(map[string][]SeriesRange, len(s.shards))
+	for _, r := range ranges {
+		name := s.ring.Get(seriesName(r.Key))
+		groups[name] = append(groups[name], r)
+	}
+
+	var mu sync.Mutex
+	return s.each(func(name string, shard *RedisStorage) error {
+		if len(groups[name]) == 0 {
+			return nil
+		}
+		return shard.ReadSeries(ctx, groups[name], func(key string, minute int, value int64) error {
+			mu.Lock()
+			defer mu.Unlock()
+			return fn(key, minute, value)
+		})
+	})
+}
+
+// SumSeries implements SeriesSummer. ErrUnsupported is returned if any
+// shard cannot sum its values.
+func (s *ShardedStorage) SumSeries(ctx context.Context, ranges []SeriesRange, step, phase int, fn func(string, int, int64) error) error {
+	groups := make(map[string][]SeriesRange, len(s.shards))
+	for _, r := range ranges {
+		name := s.ring.Get(seriesName(r.Key))
+		groups[name] = append(groups[name], r)
+	}
+
+	type bucket struct {
+		key    string
+		minute int
+		sum    int64
+	}
+
+	var mu sync.Mutex
+	var buckets []bucket
+	if err := s.each(func(name string, shard *RedisStorage) error {
+		if len(groups[name]) == 0 {
+			return nil
+		}
+		return shard.SumSeries(ctx, groups[name], step, phase, func(key string, minute int, sum int64) error {
+			mu.Lock()
+			defer mu.Unlock()
+			buckets = append(buckets, bucket{key: key, minute: minute, sum: sum})
+			return nil
+		})
+	}); err != nil {
+		return err
+	}
+
+	for _, b := range buckets {
+		if err := fn(b.key, b.minute, b.sum); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove implements Storage.
+func (s *ShardedStorage) Remove(ctx context.Context, removals []Removal) error {
+	groups := make(map[string][]Removal, len(s.shards))
+	for _, rem := range removals {
+		name := s.ring.Get(seriesName(rem.Key))
+		groups[name] = append(groups[name], rem)
+	}
+
+	return s.each(func(name string, shard *RedisStorage) error {
+		if len(groups[name]) == 0 {
+			return nil
+		}
+		return shard.Remove(ctx, groups[name])
+	})
+}
+
+// CompactIndex implements Storage. The cycle has wrapped once it has
+// wrapped on all shards.
+func (s *ShardedStorage) CompactIndex(ctx context.Context, expired func(string) (bool, error), full bool) (*CompactStats, error) {
+	var mu sync.Mutex
+	total := &CompactStats{Wrapped: true}
+	err := s.each(func(_ string, shard *RedisStorage) error {
+		stats, err := shard.CompactIndex(ctx, func(key string) (bool, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			return expired(key)
+		}, full)
+		if err != nil {
+			return err
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		total.KeysScanned += stats.KeysScanned
+		total.MembersRemoved += stats.MembersRemoved
+		total.Wrapped = total.Wrapped && stats.Wrapped
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return total, nil
+}
+
+// Close implements Storage.
+func (s *ShardedStorage) Close() error {
+	return s.each(func(_ string, shard *RedisStorage) error {
+		return shard.Close()
+	})
+}
+
+// MigrateIndex converts index sets of earlier versions on all shards, see
+// RedisStorage.MigrateIndex. It returns the number of converted sets.
+func (s *ShardedStorage) MigrateIndex(ctx context.Context) (int, error) {
+	var mu sync.Mutex
+	total := 0
+
+	err := s.each(func(_ string, shard *RedisStorage) error {
+		n, err := shard.MigrateIndex(ctx)
+
+		mu.Lock()
+		total += n
+		mu.Unlock()
+		return err
+	})
+	return total, err
+}
+
+// Rebalance moves series which are not stored on their designated shard,
+// typically after a shard was added. Values of moved series are added to
+// existing values on the target shard. It returns the number of moved keys.
+func (s *ShardedStorage) Rebalance(ctx context.Context) (int, error) {
+	var mu sync.Mutex
+	moved := 0
+
+	err := s.each(func(name string, shard *RedisStorage) error {
+		var keys []string
+		if err := shard.scanAll(ctx, "s:*", func(key string) error {
+			if key = shard.logicalKey(key); s.ring.Get(seriesName(key)) != name {
+				keys = append(keys, key)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			if err := s.move(shard, key); err != nil {
+				return err
+			}
+
+			mu.Lock()
+			moved++
+			mu.Unlock()
+		}
+		return nil
+	})
+	return moved, err
+}
+
+// moves a series key from a source shard to its target shard
+func (s *ShardedStorage) move(source *RedisStorage, key string) error {
+	ser, err := parseSeries(key)
+	if err != nil {
+		return err
+	}
+	index := seriesIndex(ser.metric, ser.tags)
+
+	if err := source.migrate(key); err != nil {
+		return err
+	}
+
+	// read and delete in one transaction, so that no values written to the
+	// source in between are lost
+	pkey := source.key(key)
+	var ttlCmd *redis.DurationCmd
+	var fieldsCmd *redis.StringStringMapCmd
+	if _, err := source.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		ttlCmd = pipe.PTTL(pkey)
+		fieldsCmd = pipe.HGetAll(pkey)
+		pipe.Del(pkey)
+		return nil
+	}); err != nil {
+		return err
+	}
+	ttl, fields := ttlCmd.Val(), fieldsCmd.Val()
+
+	// keys without expiry are moved without expiry
+	if len(fields) != 0 {
+		batch := &Batch{Incr: true, Entries: make([]Entry, 0, len(fields))}
+		for field, str := range fields {
+			minute, _ := strconv.Atoi(field)
+			value, err := strconv.ParseInt(str, 10, 64)
+			if err != nil {
+				return err
+			}
+			batch.Entries = append(batch.Entries, Entry{Key: key, Minute: minute, Value: value, Index: index, TTL: ttl})
+		}
+
+		target := s.shards[s.ring.Get(seriesName(key))]
+		if err := target.Write(batch); err != nil {
+			// put the values back, the series remains indexed on the source
+			_ = source.Write(batch)
+			return err
+		}
+	}
+
+	pipes := source.pipelines()
+	defer pipes.Close()
+
+	source.unindex(pipes, Removal{Key: key, Index: index})
+	return pipes.Exec()
+}
+
+// runs fn for each shard in parallel
+func (s *ShardedStorage) each(fn func(string, *RedisStorage) error) error {
+	errs := make(chan error, len(s.shards))
+	for name, shard := range s.shards {
+		go func(name string, shard *RedisStorage) {
+			errs <- fn(name, shard)
+		}(name, shard)
+	}
+
+	var err error
+	for range s.shards {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// seriesName extracts the series name from a s:<series>:<unix-day> key
+func seriesName(key string) string {
+	if piv := strings.LastIndexByte(key, ':'); piv > 2 {
+		return key[2:piv]
+	}
+	return key
+}
+
+// --------------------------------------------------------------------
+
+const hashRingReplicas = 128
+
+type hashRing struct {
+	hashes []uint32
+	names  map[uint32]string
+}
+
+func newHashRing(names []string) *hashRing {
+	r := &hashRing{names: make(map[uint32]string, len(names)*hashRingReplicas)}
+	for _, name := range names {
+		for i := 0; i < hashRingReplicas; i++ {
+			h := crc32.ChecksumIEEE([]byte(name + "#" + strconv.Itoa(i)))
+			r.hashes = append(r.hashes, h)
+			r.names[h] = name
+		}
+	}
+	sort.Sort(uint32Slice(r.hashes))
+	return r
+}
+
+// Get returns the name of the node responsible for a value.
+func (r *hashRing) Get(s string) string {
+	if len(r.hashes) == 0 {
+		return ""
+	}
+
+	h := crc32.ChecksumIEEE([]byte(s))
+	n := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+	if n == len(r.hashes) {
+		n = 0
+	}
+	return r.names[r.hashes[n]]
+}
+
+type uint32Slice []uint32
+
+func (p uint32Slice) Len() int           { return len(p) }
+func (p uint32Slice) Less(i, j int) bool { return p[i] < p[j] }
+func (p uint32Slice) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
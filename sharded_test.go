@@ -0,0 +1,145 @@
+package cntdb
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ShardedStorage", func() {
+	var clients map[string]*redis.Client
+	var subject *DB
+
+	shards := func(names ...string) *ShardedStorage {
+		stores := make(map[string]*RedisStorage, len(names))
+		for _, name := range names {
+			stores[name] = NewRedisStorage(clients[name])
+		}
+		return NewShardedStorage(stores)
+	}
+
+	query := func(db *DB) ResultSet {
+		res, err := db.Query(context.Background(), &Criteria{
+			Metric:   "cpu",
+			Tags:     []string{"dc:x"},
+			From:     xmltime("2014-10-24T00:00:00Z"),
+			Until:    xmltime("2014-10-26T00:00:00Z"),
+			Interval: 24 * time.Hour,
+		})
+		Expect(err).NotTo(HaveOccurred())
+		return res
+	}
+
+	newDB := func(store Storage) *DB {
+		db := New(store)
+		db.now = fixedClock("2014-10-25T00:00:00Z")
+		return db
+	}
+
+	BeforeEach(func() {
+		clients = map[string]*redis.Client{
+			"a": redis.NewClient(&redis.Options{Addr: "localhost:6379", DB: 10}),
+			"b": redis.NewClient(&redis.Options{Addr: "localhost:6379", DB: 11}),
+			"c": redis.NewClient(&redis.Options{Addr: "localhost:6379", DB: 12}),
+			"0": redis.NewClient(&redis.Options{Addr: "localhost:6379", DB: 13}),
+		}
+		subject = newDB(shards("a", "b"))
+
+		points := make([]Point, 0, 40)
+		for i := 0; i < 20; i++ {
+			points = append(points,
+				point(fmt.Sprintf("cpu,host:%d,dc:x 1414141414 1", i)),
+				point(fmt.Sprintf("cpu,host:%d,dc:x 1414230000 2", i)),
+			)
+		}
+		Expect(subject.Increment(points)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		for _, client := range clients {
+			client.FlushDb()
+			client.Close()
+		}
+	})
+
+	It("should spread series", func() {
+		keysA := clients["a"].Keys("s:*").Val()
+		keysB := clients["b"].Keys("s:*").Val()
+		Expect(keysA).NotTo(BeEmpty())
+		Expect(keysB).NotTo(BeEmpty())
+		Expect(len(keysA) + len(keysB)).To(Equal(40))
+
+		Expect(len(indexMembers(clients["a"], "t:dc:x")) + len(indexMembers(clients["b"], "t:dc:x"))).To(Equal(40))
+		for _, key := range keysA {
+			Expect(clients["b"].Exists(key).Val()).To(Equal(int64(0)), "for %s", key)
+		}
+	})
+
+	It("should query", func() {
+		Expect(query(subject)).To(Equal(ResultSet{
+			{xmltime("2014-10-24T00:00:00Z"), 20, xmltime("2014-10-25T00:00:00Z")},
+			{xmltime("2014-10-25T00:00:00Z"), 40, xmltime("2014-10-26T00:00:00Z")},
+		}))
+	})
+
+	It("should rebalance", func() {
+		store := shards("a", "b", "c")
+		Expect(query(newDB(store))).NotTo(Equal(query(subject)))
+
+		n, err := store.Rebalance(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(n).To(BeNumerically(">", 0))
+		Expect(clients["c"].Keys("s:*").Val()).To(HaveLen(n))
+		Expect(clients["c"].TTL(clients["c"].Keys("s:*").Val()[0]).Val()).To(BeNumerically(">", storageTTL-time.Minute))
+
+		Expect(query(newDB(store))).To(Equal(ResultSet{
+			{xmltime("2014-10-24T00:00:00Z"), 20, xmltime("2014-10-25T00:00:00Z")},
+			{xmltime("2014-10-25T00:00:00Z"), 40, xmltime("2014-10-26T00:00:00Z")},
+		}))
+		Expect(len(indexMembers(clients["a"], "t:dc:x")) + len(indexMembers(clients["b"], "t:dc:x"))).To(Equal(40 - n))
+
+		n, err = store.Rebalance(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(n).To(Equal(0))
+	})
+
+	It("should rebalance series without expiry", func() {
+		for _, name := range []string{"a", "b"} {
+			for _, key := range clients[name].Keys("s:*").Val() {
+				Expect(clients[name].Persist(key).Err()).NotTo(HaveOccurred())
+			}
+		}
+
+		store := shards("a", "b", "c")
+		n, err := store.Rebalance(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(n).To(BeNumerically(">", 0))
+		Expect(clients["c"].Keys("s:*").Val()).To(HaveLen(n))
+		for _, key := range clients["c"].Keys("s:*").Val() {
+			Expect(clients["c"].TTL(key).Val()).To(Equal(-time.Second), "for %s", key)
+		}
+
+		Expect(query(newDB(store))).To(Equal(ResultSet{
+			{xmltime("2014-10-24T00:00:00Z"), 20, xmltime("2014-10-25T00:00:00Z")},
+			{xmltime("2014-10-25T00:00:00Z"), 40, xmltime("2014-10-26T00:00:00Z")},
+		}))
+	})
+
+	It("should read meta records from all shards", func() {
+		Expect(subject.SetRetention("cpu", 90*24*time.Hour)).To(Succeed())
+		Expect(subject.SetRetention("mem", 60*24*time.Hour)).To(Succeed())
+		Expect(clients["b"].HSet("meta:retention", "mem", "720h0m0s").Err()).NotTo(HaveOccurred())
+
+		policies, err := newDB(shards("0", "a", "b")).RetentionPolicies(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(policies).To(Equal(map[string]time.Duration{
+			"cpu": 90 * 24 * time.Hour,
+			"mem": 60 * 24 * time.Hour,
+		}))
+	})
+
+})
@@ -0,0 +1,108 @@
+package cntdb
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+const minutesPerDay = 24 * 60
+
+// ErrUnsupported is returned by optional storage operations which cannot be
+// performed, callers fall back to the generic Storage methods.
+var ErrUnsupported = errors.New("cntdb: operation not supported")
+
+// Storage is an abstract storage back-end. Series are identified by keys in
+// the format s:<series>:<unix-day>, index sets are named m:<metric> and
+// t:<tag> and contain series keys. Implementations must be safe for
+// concurrent use, queries read index sets and series concurrently.
+type Storage interface {
+	// Write applies a batch of writes.
+	Write(batch *Batch) error
+
+	// ScanIndex calls fn for each series key in the index set. Implementations
+	// may skip keys outside of the minDay..maxDay range, but are not
+	// required to.
+	ScanIndex(ctx context.Context, index string, minDay, maxDay int64, fn func(key string) error) error
+
+	// ReadSeries reads ranges of series keys and calls fn for each stored
+	// minute value within the ranges.
+	ReadSeries(ctx context.Context, ranges []SeriesRange, fn func(key string, minute int, value int64) error) error
+
+	// Remove removes series values. Series keys which no longer hold any
+	// values are removed from their index sets.
+	Remove(ctx context.Context, removals []Removal) error
+
+	// CompactIndex removes expired keys from index sets. Unless full is set,
+	// implementations may process only a portion of all index sets per call.
+	CompactIndex(ctx context.Context, expired func(key string) (bool, error), full bool) (*CompactStats, error)
+
+	// ReadMeta returns all fields of a named meta record.
+	ReadMeta(ctx context.Context, name string) (map[string]string, error)
+
+	// WriteMeta stores a field of a named meta record. Empty values remove
+	// the field.
+	WriteMeta(name, field, value string) error
+
+	// Close closes the storage.
+	Close() error
+}
+
+// SeriesSummer is an optional interface implemented by storages which can
+// sum series values into buckets without reading them.
+type SeriesSummer interface {
+	// SumSeries sums the values within ranges of series keys into buckets
+	// of step minutes, starting at phase minutes into each day. It calls fn
+	// for each bucket with a value, passing a minute of the bucket within
+	// the range. ErrUnsupported is returned if values cannot be summed,
+	// before fn is called.
+	SumSeries(ctx context.Context, ranges []SeriesRange, step, phase int, fn func(key string, minute int, sum int64) error) error
+}
+
+// Batch is a batch of writes.
+type Batch struct {
+	// Incr adds values to existing ones instead of replacing them.
+	Incr bool
+	// Entries to write.
+	Entries []Entry
+}
+
+// Entry is a single series value.
+type Entry struct {
+	Key    string        // series key
+	Minute int           // minute of day
+	Value  int64         // value
+	Index  []string      // index sets the series key belongs to
+	TTL    time.Duration // remaining TTL of the series key
+}
+
+// SeriesRange is a range of minutes of a series key.
+type SeriesRange struct {
+	Key string // series key
+	Min int    // first minute of day
+	Max int    // last minute of day, inclusive
+}
+
+// FullDay returns a range spanning all minutes of a series key.
+func FullDay(key string) SeriesRange {
+	return SeriesRange{Key: key, Min: 0, Max: minutesPerDay - 1}
+}
+
+// Contains returns true if the minute is within the range.
+func (r SeriesRange) Contains(minute int) bool {
+	return minute >= r.Min && minute <= r.Max
+}
+
+// Removal removes values of a series key.
+type Removal struct {
+	Key     string   // series key
+	Minutes []int    // minutes of day to remove, all if empty
+	Index   []string // index sets the series key belongs to
+}
+
+// CompactStats reports the progress of a compaction cycle.
+type CompactStats struct {
+	KeysScanned    int  // number of inspected index sets
+	MembersRemoved int  // number of expired keys removed from index sets
+	Wrapped        bool // true if the cycle completed a pass over all index sets
+}
@@ -0,0 +1,93 @@
+package cntdb
+
+import (
+	"context"
+	"sort"
+)
+
+// RankBy determines how series are ranked by TopN.
+type RankBy int
+
+const (
+	// RankBySum ranks by the total of all buckets.
+	RankBySum RankBy = iota
+	// RankByMax ranks by the highest bucket.
+	RankByMax
+	// RankByLast ranks by the last bucket of the queried range.
+	RankByLast
+)
+
+// TopNOptions configure TopN.
+type TopNOptions struct {
+	// N is the number of returned ranks, all if zero.
+	N int
+	// By determines the ranking value.
+	By RankBy
+	// Ascending returns the lowest ranking values first.
+	Ascending bool
+	// WithResults includes the result set of each rank.
+	WithResults bool
+}
+
+// Rank is a ranked series or group.
+type Rank struct {
+	Group
+	Value int64 // the ranking value
+}
+
+// TopN ranks series matching the criteria by their bucket values and returns
+// the top ranks, in descending order by default. Ranks identify individual
+// series by their tags or, if Criteria.GroupBy is set, groups of series as
+// in QueryGrouped. Ties are ordered by tags.
+func (b *DB) TopN(ctx context.Context, c *Criteria, opt *TopNOptions) ([]Rank, error) {
+	if opt == nil {
+		opt = new(TopNOptions)
+	}
+
+	groupBy := func(s series) []string { return s.tags }
+	if len(c.GroupBy) != 0 {
+		groupBy = func(s series) []string { return groupTags(s.tags, c.GroupBy) }
+	}
+
+	groups, err := b.queryGroups(ctx, c, groupBy)
+	if err != nil {
+		return nil, err
+	}
+
+	last := c.getBucketing().Start(c.getUntil().Time)
+	ranks := make([]Rank, 0, len(groups))
+	for _, grp := range groups {
+		rank := Rank{Group: grp}
+		for i, res := range grp.Results {
+			switch opt.By {
+			case RankBySum:
+				rank.Value += res.Value
+			case RankByMax:
+				if i == 0 || res.Value > rank.Value {
+					rank.Value = res.Value
+				}
+			case RankByLast:
+				if res.Timestamp.Equal(last) {
+					rank.Value = res.Value
+				}
+			}
+		}
+		if !opt.WithResults {
+			rank.Results = nil
+		}
+		ranks = append(ranks, rank)
+	}
+
+	// groups are sorted by tags, a stable sort preserves that order for ties
+	sort.SliceStable(ranks, func(i, j int) bool {
+		if opt.Ascending {
+			return ranks[i].Value < ranks[j].Value
+		}
+		return ranks[i].Value > ranks[j].Value
+	})
+
+	if opt.N > 0 && opt.N < len(ranks) {
+		ranks = ranks[:opt.N]
+	}
+	return ranks, nil
+}
@@ -0,0 +1,96 @@
+package cntdb
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-redis/redis"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("TopN", func() {
+	var subject *DB
+	var client *redis.Client
+
+	crit := &Criteria{
+		Metric:   "req",
+		From:     xmltime("2014-10-24T09:00:00Z"),
+		Until:    xmltime("2014-10-24T11:59:00Z"),
+		Interval: time.Hour,
+	}
+
+	BeforeEach(func() {
+		subject, client = openTestDB("2014-10-25T00:00:00Z")
+
+		Expect(subject.Increment([]Point{
+			point("req,host:a,path:x 1414141200 5"), // 2014-10-24T09:00:00Z
+			point("req,host:a,path:x 1414144800 1"), // 2014-10-24T10:00:00Z
+			point("req,host:a,path:y 1414148400 2"), // 2014-10-24T11:00:00Z
+			point("req,host:b,path:x 1414141200 3"), // 2014-10-24T09:00:00Z
+			point("req,host:b,path:x 1414144800 3"), // 2014-10-24T10:00:00Z
+			point("req,host:c,path:y 1414148400 4"), // 2014-10-24T11:00:00Z
+		})).To(Succeed())
+	})
+
+	AfterEach(func() {
+		closeTestDB(client)
+	})
+
+	It("should rank series by sum", func() {
+		ranks, err := subject.TopN(context.Background(), crit, &TopNOptions{N: 2})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ranks).To(Equal([]Rank{
+			{Group: Group{Tags: []string{"host:a", "path:x"}}, Value: 6},
+			{Group: Group{Tags: []string{"host:b", "path:x"}}, Value: 6},
+		}))
+	})
+
+	It("should rank by max and last", func() {
+		ranks, err := subject.TopN(context.Background(), crit, &TopNOptions{N: 1, By: RankByMax})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ranks).To(Equal([]Rank{
+			{Group: Group{Tags: []string{"host:a", "path:x"}}, Value: 5},
+		}))
+
+		ranks, err = subject.TopN(context.Background(), crit, &TopNOptions{By: RankByLast})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ranks).To(Equal([]Rank{
+			{Group: Group{Tags: []string{"host:c", "path:y"}}, Value: 4},
+			{Group: Group{Tags: []string{"host:a", "path:y"}}, Value: 2},
+			{Group: Group{Tags: []string{"host:a", "path:x"}}, Value: 0},
+			{Group: Group{Tags: []string{"host:b", "path:x"}}, Value: 0},
+		}))
+	})
+
+	It("should rank by last bucket with offsets", func() {
+		c := *crit
+		c.Until = xmltime("2014-10-24T11:29:00Z")
+		c.Offset = 30 * time.Minute
+
+		ranks, err := subject.TopN(context.Background(), &c, &TopNOptions{N: 2, By: RankByLast})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ranks).To(Equal([]Rank{
+			{Group: Group{Tags: []string{"host:c", "path:y"}}, Value: 4},
+			{Group: Group{Tags: []string{"host:a", "path:y"}}, Value: 2},
+		}))
+	})
+
+	It("should rank groups in ascending order", func() {
+		c := *crit
+		c.GroupBy = []string{"host:"}
+
+		ranks, err := subject.TopN(context.Background(), &c, &TopNOptions{N: 2, Ascending: true, WithResults: true})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ranks).To(Equal([]Rank{
+			{Group: Group{Tags: []string{"host:c"}, Results: ResultSet{
+				{xmltime("2014-10-24T11:00:00Z"), 4, xmltime("2014-10-24T12:00:00Z")},
+			}}, Value: 4},
+			{Group: Group{Tags: []string{"host:b"}, Results: ResultSet{
+				{xmltime("2014-10-24T09:00:00Z"), 3, xmltime("2014-10-24T10:00:00Z")},
+				{xmltime("2014-10-24T10:00:00Z"), 3, xmltime("2014-10-24T11:00:00Z")},
+			}}, Value: 6},
+		}))
+	})
+
+})
@@ -0,0 +1,116 @@
+package cntdb
+
+import (
+	"math"
+	"time"
+)
+
+// Transform transforms a result set of buckets of the given interval.
+type Transform func(res ResultSet, interval time.Duration) ResultSet
+
+// TransformRate converts bucket values into rates per unit, see
+// ResultSet.Rate.
+func TransformRate(unit time.Duration) Transform {
+	return func(res ResultSet, interval time.Duration) ResultSet { return res.Rate(interval, unit) }
+}
+
+// TransformDelta converts bucket values into differences, see
+// ResultSet.Delta.
+func TransformDelta() Transform {
+	return func(res ResultSet, _ time.Duration) ResultSet { return res.Delta() }
+}
+
+// TransformCumSum converts bucket values into running totals, see
+// ResultSet.CumSum.
+func TransformCumSum() Transform {
+	return func(res ResultSet, _ time.Duration) ResultSet { return res.CumSum() }
+}
+
+// TransformMovingSum converts bucket values into moving sums, see
+// ResultSet.MovingSum.
+func TransformMovingSum(n int) Transform {
+	return func(res ResultSet, _ time.Duration) ResultSet { return res.MovingSum(n) }
+}
+
+// TransformMovingAvg converts bucket values into moving averages, see
+// ResultSet.MovingAvg.
+func TransformMovingAvg(n int) Transform {
+	return func(res ResultSet, _ time.Duration) ResultSet { return res.MovingAvg(n) }
+}
+
+// applies transforms to a result set
+func applyTransforms(res ResultSet, interval time.Duration, transforms []Transform) ResultSet {
+	for _, fn := range transforms {
+		res = fn(res, interval)
+	}
+	return res
+}
+
+// --------------------------------------------------------------------
+
+// Rate returns the rate per unit of each bucket, rounded to the nearest
+// integer. Buckets without an end are assumed to span interval.
+func (p ResultSet) Rate(interval, unit time.Duration) ResultSet {
+	res := make(ResultSet, len(p))
+	for i, r := range p {
+		span := interval
+		if !r.End.IsZero() {
+			span = r.End.Sub(r.Timestamp)
+		}
+		res[i] = Result{r.Timestamp, int64(math.Round(float64(r.Value) * float64(unit) / float64(span))), r.End}
+	}
+	return res
+}
+
+// Delta returns the difference of each result from the previous one. The
+// first result is omitted.
+func (p ResultSet) Delta() ResultSet {
+	if len(p) < 2 {
+		return ResultSet{}
+	}
+
+	res := make(ResultSet, len(p)-1)
+	for i, r := range p[1:] {
+		res[i] = Result{r.Timestamp, r.Value - p[i].Value, r.End}
+	}
+	return res
+}
+
+// CumSum returns the running total of the results.
+func (p ResultSet) CumSum() ResultSet {
+	res := make(ResultSet, len(p))
+	var sum int64
+	for i, r := range p {
+		sum += r.Value
+		res[i] = Result{r.Timestamp, sum, r.End}
+	}
+	return res
+}
+
+// MovingSum returns the sum of each result and up to n-1 preceding results.
+func (p ResultSet) MovingSum(n int) ResultSet {
+	res := make(ResultSet, len(p))
+	var sum int64
+	for i, r := range p {
+		sum += r.Value
+		if n > 0 && i >= n {
+			sum -= p[i-n].Value
+		}
+		res[i] = Result{r.Timestamp, sum, r.End}
+	}
+	return res
+}
+
+// MovingAvg returns the average of each result and up to n-1 preceding
+// results, rounded to the nearest integer.
+func (p ResultSet) MovingAvg(n int) ResultSet {
+	res := p.MovingSum(n)
+	for i := range res {
+		size := i + 1
+		if n > 0 && size > n {
+			size = n
+		}
+		res[i].Value = int64(math.Round(float64(res[i].Value) / float64(size)))
+	}
+	return res
+}
@@ -0,0 +1,76 @@
+package cntdb
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-redis/redis"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ResultSet", func() {
+	t0 := xmltime("2014-10-24T09:00:00Z")
+	at := func(n int) time.Time { return t0.Add(time.Duration(n) * time.Hour) }
+
+	subject := ResultSet{{at(0), 3600, at(1)}, {at(1), 7200, at(2)}, {at(2), 1800, at(3)}, {at(3), 5400, at(4)}}
+
+	It("should calculate rates", func() {
+		Expect(subject.Rate(time.Hour, time.Second)).To(Equal(ResultSet{{at(0), 1, at(1)}, {at(1), 2, at(2)}, {at(2), 1, at(3)}, {at(3), 2, at(4)}}))
+		Expect(subject.Rate(time.Hour, time.Minute)).To(Equal(ResultSet{{at(0), 60, at(1)}, {at(1), 120, at(2)}, {at(2), 30, at(3)}, {at(3), 90, at(4)}}))
+		Expect(ResultSet{{at(0), 7200, at(2)}}.Rate(time.Hour, time.Minute)).To(Equal(ResultSet{{at(0), 60, at(2)}}))
+		Expect(ResultSet{{Timestamp: at(0), Value: 3600}}.Rate(time.Hour, time.Second)).To(Equal(ResultSet{{Timestamp: at(0), Value: 1}}))
+	})
+
+	It("should calculate deltas", func() {
+		Expect(subject.Delta()).To(Equal(ResultSet{{at(1), 3600, at(2)}, {at(2), -5400, at(3)}, {at(3), 3600, at(4)}}))
+		Expect(subject[:1].Delta()).To(Equal(ResultSet{}))
+	})
+
+	It("should calculate cumulative sums", func() {
+		Expect(subject.CumSum()).To(Equal(ResultSet{{at(0), 3600, at(1)}, {at(1), 10800, at(2)}, {at(2), 12600, at(3)}, {at(3), 18000, at(4)}}))
+	})
+
+	It("should calculate moving windows", func() {
+		Expect(subject.MovingSum(2)).To(Equal(ResultSet{{at(0), 3600, at(1)}, {at(1), 10800, at(2)}, {at(2), 9000, at(3)}, {at(3), 7200, at(4)}}))
+		Expect(subject.MovingAvg(3)).To(Equal(ResultSet{{at(0), 3600, at(1)}, {at(1), 5400, at(2)}, {at(2), 4200, at(3)}, {at(3), 4800, at(4)}}))
+	})
+
+	It("should not modify the original", func() {
+		subject.CumSum()
+		subject.MovingAvg(2)
+		Expect(subject[1].Value).To(Equal(int64(7200)))
+	})
+
+	Describe("transforms", func() {
+		var db *DB
+		var client *redis.Client
+
+		BeforeEach(func() {
+			db, client = openTestDB("2014-10-25T00:00:00Z")
+
+			Expect(db.Increment([]Point{
+				point("req,a 1414141200 120"), // 2014-10-24T09:00:00Z
+				point("req,a 1414144800 360"), // 2014-10-24T10:00:00Z
+				point("req,a 1414148400 240"), // 2014-10-24T11:00:00Z
+			})).To(Succeed())
+		})
+
+		AfterEach(func() {
+			closeTestDB(client)
+		})
+
+		It("should apply transforms in order", func() {
+			res, err := db.Query(context.Background(), &Criteria{
+				Metric:     "req",
+				From:       at(0),
+				Until:      at(3),
+				Interval:   time.Hour,
+				Transforms: []Transform{TransformRate(time.Minute), TransformDelta()},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(res).To(Equal(ResultSet{{at(1), 4, at(2)}, {at(2), -2, at(3)}}))
+		})
+	})
+
+})